@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"snippetbox/pkg/models"
+	"snippetbox/pkg/models/mysql"
+)
+
+// Define the default MySQL DSN, which is shared by the web server and the
+// command-line tools.
+const defaultDSN = "fei:fei@tcp(172.20.0.2)/snippetbox?parseTime=true"
+
+// Define the usage message for the user command.
+const userUsage = `usage: snippetbox user promote [-dsn DSN] [-role ROLE] EMAIL
+
+Changes the role of the user with the given email address. Use it to
+bootstrap the first admin, who can then manage everyone else.`
+
+// The userCommand type holds what a "snippetbox user ..." command needs to
+// run: the arguments to parse and how to open the user model for a DSN.
+type userCommand struct {
+	args   []string
+	out    io.Writer
+	openDB func(dsn string) (userRoleSetter, error)
+}
+
+// The userRoleSetter interface is satisfied by *mysql.UserModel.
+type userRoleSetter interface {
+	SetRoleContext(ctx context.Context, email, role string) error
+}
+
+// The runUserCommand function runs "snippetbox user promote", which changes
+// the role of a user.
+func runUserCommand(cmd *userCommand) error {
+	if len(cmd.args) == 0 || cmd.args[0] != "promote" {
+		return errors.New(userUsage)
+	}
+
+	fs := flag.NewFlagSet("user promote", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	dsn := fs.String("dsn", defaultDSN, "MySQL data source name")
+	role := fs.String("role", models.RoleAdmin, "Role to give the user ("+strings.Join(models.Roles, ", ")+")")
+	err := fs.Parse(cmd.args[1:])
+	if err != nil || fs.NArg() != 1 {
+		return errors.New(userUsage)
+	}
+	if !models.ValidRole(*role) {
+		return fmt.Errorf("unknown role %q", *role)
+	}
+	email := fs.Arg(0)
+
+	users, err := cmd.openDB(*dsn)
+	if err != nil {
+		return err
+	}
+	err = users.SetRoleContext(context.Background(), email, *role)
+	if err == models.ErrNoRecord {
+		return fmt.Errorf("no user with email %q", email)
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.out, "%s is now a %s\n", email, *role)
+	return nil
+}
+
+// The openUserModel function connects to the database and returns a
+// mysql.UserModel using it. Unlike the server, it only tries to connect
+// once.
+func openUserModel(dsn string) (userRoleSetter, error) {
+	db, err := openDB(dsn, dbConfig{connectAttempts: 1, connectTimeout: 5 * time.Second}, slog.Default())
+	if err != nil {
+		return nil, err
+	}
+	return &mysql.UserModel{DB: db}, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"snippetbox/pkg/models"
+)
+
+// The mockUsers type records the roles set through it. Only users in the map
+// exist.
+type mockUsers map[string]string
+
+func (m mockUsers) SetRoleContext(ctx context.Context, email, role string) error {
+	if _, ok := m[email]; !ok {
+		return models.ErrNoRecord
+	}
+	m[email] = role
+	return nil
+}
+
+func TestUserCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantErr  string
+		wantRole string
+	}{
+		{name: "Promote", args: []string{"promote", "alice@example.com"}, wantRole: models.RoleAdmin},
+		{name: "Role", args: []string{"promote", "-role", "moderator", "alice@example.com"}, wantRole: models.RoleModerator},
+		{name: "Unknown role", args: []string{"promote", "-role", "owner", "alice@example.com"}, wantErr: "unknown role", wantRole: models.RoleUser},
+		{name: "Unknown user", args: []string{"promote", "bob@example.com"}, wantErr: "no user", wantRole: models.RoleUser},
+		{name: "No email", args: []string{"promote"}, wantErr: "usage", wantRole: models.RoleUser},
+		{name: "Unknown command", args: []string{"demote", "alice@example.com"}, wantErr: "usage", wantRole: models.RoleUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := mockUsers{"alice@example.com": models.RoleUser}
+			var out bytes.Buffer
+			err := runUserCommand(&userCommand{
+				args:   tt.args,
+				out:    &out,
+				openDB: func(string) (userRoleSetter, error) { return users, nil },
+			})
+
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("want error containing %q; got %v", tt.wantErr, err)
+			}
+			if users["alice@example.com"] != tt.wantRole {
+				t.Errorf("want role %q; got %q", tt.wantRole, users["alice@example.com"])
+			}
+		})
+	}
+}
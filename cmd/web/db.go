@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/XSAM/otelsql"
+)
+
+// The dbConfig type holds the settings for the database connection pool, and
+// for connecting to the database at startup.
+type dbConfig struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+
+	// The connection is attempted up to connectAttempts times, waiting
+	// connectBackoff after the first failure and twice as long after each
+	// one after that, up to maxConnectBackoff. Each attempt gives up after
+	// connectTimeout.
+	connectAttempts int
+	connectBackoff  time.Duration
+	connectTimeout  time.Duration
+}
+
+// The maxConnectBackoff constant caps the time we wait between attempts to
+// connect to the database at startup.
+const maxConnectBackoff = 10 * time.Second
+
+// The openDB() function wraps sql.Open() and returns a sql.DB connection pool
+// for a given DSN, with the pool limits from the config. The MySQL driver is
+// wrapped by otelsql, so that queries made with the context of a traced
+// request are recorded as spans. The database often isn't ready yet when we
+// start (for example when both are started by docker-compose), so it waits
+// for it to answer a ping with waitForDB().
+func openDB(dsn string, cfg dbConfig, logger *slog.Logger) (*sql.DB, error) {
+	db, err := otelsql.Open("mysql", dsn, sqlTraceOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.maxOpenConns)
+	db.SetMaxIdleConns(cfg.maxIdleConns)
+	db.SetConnMaxLifetime(cfg.connMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.connMaxIdleTime)
+
+	err = waitForDB(context.Background(), db, cfg.connectAttempts, cfg.connectBackoff, cfg.connectTimeout, logger)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// The waitForDB function pings the database until it answers, up to the
+// given number of attempts, backing off exponentially between them. Each
+// attempt fails if the database hasn't answered within the timeout (unless
+// it's zero), so that a ping which hangs, for example because packets to the
+// database are being dropped, doesn't stop us from retrying. Each failure is
+// logged along with how long we'll wait before trying again. If the last
+// attempt fails, its error is returned.
+func waitForDB(ctx context.Context, db pinger, attempts int, backoff, timeout time.Duration, logger *slog.Logger) error {
+	for attempt := 1; ; attempt++ {
+		err := pingDB(ctx, db, timeout)
+		if err == nil {
+			if attempt > 1 {
+				logger.Info("connected to database", "attempt", attempt)
+			}
+			return nil
+		}
+		if attempt >= attempts {
+			return fmt.Errorf("connecting to database: giving up after %d attempts: %w", attempt, err)
+		}
+
+		logger.Warn("connecting to database", "attempt", attempt, "of", attempts, "error", err, "retry_in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+// The pingDB function pings the database, giving up after the timeout if
+// it's not zero.
+func pingDB(ctx context.Context, db pinger, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return db.PingContext(ctx)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The flakyPinger type is a pinger which fails until it has been pinged a
+// given number of times.
+type flakyPinger struct {
+	failures int
+	pings    int
+}
+
+func (p *flakyPinger) PingContext(ctx context.Context) error {
+	p.pings++
+	if p.pings <= p.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+// The hangingPinger type is a pinger which never answers, and only returns
+// once the context is done.
+type hangingPinger struct {
+	pings int
+}
+
+func (p *hangingPinger) PingContext(ctx context.Context) error {
+	p.pings++
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestWaitForDB(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		attempts  int
+		wantPings int
+		wantErr   bool
+	}{
+		{"Ready", 0, 5, 1, false},
+		{"Ready after retries", 3, 5, 4, false},
+		{"Never ready", 10, 5, 5, true},
+		{"Single attempt", 1, 1, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := newLogger(&buf, "text", "info")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db := &flakyPinger{failures: tt.failures}
+			err = waitForDB(context.Background(), db, tt.attempts, time.Millisecond, time.Second, logger)
+			if tt.wantErr && err == nil {
+				t.Error("want error; got nil")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("want no error; got %v", err)
+			}
+			if db.pings != tt.wantPings {
+				t.Errorf("want %d pings; got %d", tt.wantPings, db.pings)
+			}
+
+			// Each failed attempt which is retried is logged.
+			retries := min(tt.failures, tt.attempts-1)
+			if n := strings.Count(buf.String(), "retry_in="); n != retries {
+				t.Errorf("want %d retries logged; got %d:\n%s", retries, n, buf.String())
+			}
+		})
+	}
+}
+
+func TestWaitForDBCancel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "text", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiting stops as soon as the context is cancelled, rather than after
+	// all the attempts have been made.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	db := &flakyPinger{failures: 100}
+	err = waitForDB(ctx, db, 100, time.Hour, time.Second, logger)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %v; got %v", context.DeadlineExceeded, err)
+	}
+	if db.pings != 1 {
+		t.Errorf("want 1 ping; got %d", db.pings)
+	}
+}
+
+func TestWaitForDBTimeout(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "text", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each attempt times out on its own, so a ping which hangs is retried.
+	db := &hangingPinger{}
+	err = waitForDB(context.Background(), db, 3, time.Millisecond, 10*time.Millisecond, logger)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %v; got %v", context.DeadlineExceeded, err)
+	}
+	if db.pings != 3 {
+		t.Errorf("want 3 pings; got %d", db.pings)
+	}
+}
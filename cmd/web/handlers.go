@@ -1,14 +1,28 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
+	"time"
 
 	"snippetbox/pkg/forms"
 	"snippetbox/pkg/models"
+	"snippetbox/pkg/models/mysql"
+	"snippetbox/pkg/totp"
+
+	"golang.org/x/oauth2"
 )
 
+// The base64URLRX regular expression matches unpadded base64url-encoded data,
+// which is how the browser sends the ciphertext of encrypted snippets.
+var base64URLRX = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 // Change the signature of the home handler so it is defined as a method against
 // *application.
 func (app *application) home(w http.ResponseWriter, r *http.Request) {
@@ -21,14 +35,22 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 
 	// panic("oops! something went wrong")
 
-	s, err := app.snippets.Latest()
+	s, err := app.snippets.LatestContext(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Fetch the most starred snippets of the week to show alongside the
+	// latest ones.
+	p, err := app.snippets.PopularContext(r.Context())
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
 	// Use the render() helper.
-	app.render(w, r, "home.page.html", &templateData{Snippets: s})
+	app.render(w, r, "home.page.html", &templateData{Snippets: s, Popular: p})
 
 	// Create an instance of a templateData struct holding the slice of snippets.
 	//
@@ -51,7 +73,7 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 	//
 	// ts, err := template.ParseFiles(files...)
 	// if err != nil {
-	// 	app.serverError(w, err) // Use the serveError() helper.
+	// 	app.serverError(w, r, err) // Use the serveError() helper.
 	// 	return
 	// }
 
@@ -61,7 +83,7 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 	//
 	// err = ts.Execute(w, data)
 	// if err != nil {
-	// 	app.serverError(w, err) // Use the serveError() helper.
+	// 	app.serverError(w, r, err) // Use the serveError() helper.
 	// }
 }
 
@@ -79,12 +101,19 @@ func (app *application) showSnippet(w http.ResponseWriter, r *http.Request) {
 	// Use the SnippetModel object's Get method to retrieve the data for a
 	// specific record based on its ID. If no matching record is found,
 	// return a 404 Not Found response.
-	s, err := app.snippets.Get(id)
+	s, err := app.snippets.GetContext(r.Context(), id)
 	if err == models.ErrNoRecord {
 		app.notFound(w)
 		return
 	} else if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Snippets which are private to someone else are reported as missing,
+	// so that we don't leak whether they exist.
+	if !app.canView(r, s) {
+		app.notFound(w)
 		return
 	}
 
@@ -94,11 +123,33 @@ func (app *application) showSnippet(w http.ResponseWriter, r *http.Request) {
 	// data this will return the empty string.
 	// flash := app.session.PopString(r, "flash")
 
-	// Use the render() helper.
-	app.render(w, r, "show.page.html", &templateData{
-		// Flash: flash,
-		Snippet: s,
-	})
+	// Encrypted snippets are decrypted in the browser, so we only render an
+	// empty page shell which fetches the ciphertext from the API. Their
+	// content must never be rendered on the server.
+	if s.Encrypted {
+		app.recordView(r, s)
+		app.render(w, r, "decrypt.page.html", &templateData{
+			Snippet: &models.Snippet{ID: s.ID, Title: s.Title, Created: s.Created, Expires: s.Expires},
+		})
+		return
+	}
+
+	// If the snippet is password-protected and hasn't been unlocked yet,
+	// show the unlock form instead of its content.
+	if !app.unlocked(r, s) {
+		app.render(w, r, "unlock.page.html", &templateData{
+			Form:    forms.New(nil),
+			Snippet: &models.Snippet{ID: s.ID, Title: s.Title},
+		})
+		return
+	}
+
+	// Count the view. This only updates an in-memory counter, which is
+	// flushed to the database in the background.
+	app.recordView(r, s)
+
+	// Use the renderSnippet() helper, passing in an empty comment form.
+	app.renderSnippet(w, r, s, forms.New(nil))
 
 	// Create an instance of a templateData struct holding the snippet data.
 	//
@@ -117,7 +168,7 @@ func (app *application) showSnippet(w http.ResponseWriter, r *http.Request) {
 	//
 	// ts, err := template.ParseFiles(files...)
 	// if err != nil {
-	// 	app.serverError(w, err)
+	// 	app.serverError(w, r, err)
 	// 	return
 	// }
 
@@ -126,10 +177,72 @@ func (app *application) showSnippet(w http.ResponseWriter, r *http.Request) {
 	//
 	// err = ts.Execute(w, data)
 	// if err != nil {
-	// 	app.serverError(w, err)
+	// 	app.serverError(w, r, err)
 	// }
 }
 
+func (app *application) unlockSnippet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	s, err := app.snippets.GetContext(r.Context(), id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !app.canView(r, s) {
+		app.notFound(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	data := &templateData{
+		Form:    form,
+		Snippet: &models.Snippet{ID: s.ID, Title: s.Title},
+	}
+
+	// Repeated wrong guesses from the same client are throttled, so that
+	// the password can't be brute-forced.
+	key := fmt.Sprintf("%d:%s", s.ID, clientIP(r))
+	if !app.unlockAttempts.Allow(key) {
+		form.Errors.Add("generic", "Too many incorrect attempts. Please try again later.")
+		app.render(w, r, "unlock.page.html", data)
+		return
+	}
+
+	err = app.snippets.AuthenticateContext(r.Context(), s.ID, form.Get("password"))
+	if err == models.ErrInvalidCredentials {
+		app.unlockAttempts.Fail(key)
+		form.Errors.Add("generic", "Password is incorrect")
+		app.render(w, r, "unlock.page.html", data)
+		return
+	} else if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.unlockAttempts.Reset(key)
+
+	// Remember the unlock in the session for a limited time.
+	app.putSessionExpiry(r, unlockSessionKey(s.ID), time.Now().Add(unlockLifetime))
+
+	http.Redirect(w, r, fmt.Sprintf("/snippet/%d", s.ID), http.StatusSeeOther)
+}
+
 func (app *application) createSnippetForm(w http.ResponseWriter, r *http.Request) {
 	app.render(w, r, "create.page.html", &templateData{
 		// Pass a new empty forms.Form object to the template.
@@ -205,6 +318,8 @@ func (app *application) createSnippet(w http.ResponseWriter, r *http.Request) {
 	form.Required("title", "content", "expires")
 	form.MaxLength("title", 100)
 	form.PermittedValues("expires", "365", "7", "1")
+	form.PermittedValues("private", "true")
+	form.MaxBytes("password", forms.MaxPasswordBytes)
 
 	// If the form isn't valid, redisplay the template passing in the
 	// form.Form object as the data.
@@ -219,11 +334,13 @@ func (app *application) createSnippet(w http.ResponseWriter, r *http.Request) {
 	// Because the form data (with type url.Values) has been anonymously embedde
 	// in the form.Form struct, we can use the Get() method to retrieve
 	// the validated value for a particular form field.
-	id, err := app.snippets.Insert(form.Get("title"), form.Get("content"), form.Get("expires"))
+	id, err := app.snippets.InsertContext(r.Context(), form.Get("title"), form.Get("content"), form.Get("expires"),
+		app.authenticatedUser(r).ID, form.Get("private") == "true", form.Get("password"))
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
+	app.metrics.snippetCreated()
 
 	// Use the Put() method to add a string value ("Your snippet was saved
 	// successfully!") and the corresponding key ("flash") to the session
@@ -238,6 +355,295 @@ func (app *application) createSnippet(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, fmt.Sprintf("/snippet/%d", id), http.StatusSeeOther)
 }
 
+func (app *application) starSnippet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	// Make sure the snippet exists (and hasn't expired) before starring it.
+	s, err := app.snippets.GetContext(r.Context(), id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !app.canView(r, s) {
+		app.notFound(w)
+		return
+	}
+
+	err = app.stars.Insert(app.authenticatedUser(r).ID, id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Snippet starred!")
+	http.Redirect(w, r, fmt.Sprintf("/snippet/%d", id), http.StatusSeeOther)
+}
+
+func (app *application) unstarSnippet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	err = app.stars.Delete(app.authenticatedUser(r).ID, id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Snippet unstarred.")
+	http.Redirect(w, r, fmt.Sprintf("/snippet/%d", id), http.StatusSeeOther)
+}
+
+func (app *application) starredSnippets(w http.ResponseWriter, r *http.Request) {
+	s, err := app.stars.Starred(app.authenticatedUser(r).ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.render(w, r, "starred.page.html", &templateData{Snippets: s})
+}
+
+func (app *application) dashboard(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	s, err := app.snippets.ByUserContext(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	daily, err := app.viewStats.Daily(user.ID, chartDays)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.render(w, r, "dashboard.page.html", &templateData{
+		Chart:    newChart(daily, today(), chartDays),
+		Snippets: s,
+	})
+}
+
+func (app *application) createComment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	s, err := app.snippets.GetContext(r.Context(), id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !app.canView(r, s) {
+		app.notFound(w)
+		return
+	}
+	if !app.unlocked(r, s) {
+		http.Redirect(w, r, fmt.Sprintf("/snippet/%d", s.ID), http.StatusSeeOther)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("content")
+	form.MaxLength("content", 2000)
+
+	// Replies are only allowed one level deep, so the parent (if any) must
+	// be a top-level comment on the same snippet.
+	var parentID int
+	if form.Get("parent_id") != "" {
+		parentID, err = strconv.Atoi(form.Get("parent_id"))
+		if err != nil || parentID < 1 {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+		parent, err := app.comments.Get(parentID)
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if parent.SnippetID != s.ID || parent.ParentID != 0 {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		app.renderSnippet(w, r, s, form)
+		return
+	}
+
+	cid, err := app.comments.Insert(s.ID, app.authenticatedUser(r).ID, parentID, form.Get("content"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Comment added!")
+	http.Redirect(w, r, fmt.Sprintf("/snippet/%d#comment-%d", s.ID, cid), http.StatusSeeOther)
+}
+
+func (app *application) editCommentForm(w http.ResponseWriter, r *http.Request) {
+	c, ok := app.authoredComment(w, r)
+	if !ok {
+		return
+	}
+
+	app.render(w, r, "comment.page.html", &templateData{
+		Comment: c,
+		Form:    forms.New(url.Values{"content": []string{c.Content}}),
+	})
+}
+
+func (app *application) editComment(w http.ResponseWriter, r *http.Request) {
+	c, ok := app.authoredComment(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("content")
+	form.MaxLength("content", 2000)
+
+	if !form.Valid() {
+		app.render(w, r, "comment.page.html", &templateData{Comment: c, Form: form})
+		return
+	}
+
+	err = app.comments.Update(c.ID, form.Get("content"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Comment updated!")
+	http.Redirect(w, r, fmt.Sprintf("/snippet/%d#comment-%d", c.SnippetID, c.ID), http.StatusSeeOther)
+}
+
+func (app *application) deleteComment(w http.ResponseWriter, r *http.Request) {
+	c, ok := app.authoredComment(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.comments.Delete(c.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Comment deleted.")
+	http.Redirect(w, r, fmt.Sprintf("/snippet/%d", c.SnippetID), http.StatusSeeOther)
+}
+
+func (app *application) createEncryptedSnippetForm(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "encrypt.page.html", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+// The maxCiphertextLength constant limits the size of the (base64url-encoded)
+// ciphertext accepted for an encrypted snippet.
+const maxCiphertextLength = 1 << 20
+
+func (app *application) createEncryptedSnippet(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Ciphertext string `json:"ciphertext"`
+		Meta       string `json:"meta"`
+		Expires    string `json:"expires"`
+	}
+
+	// Limit the size of the request body, so that a client can't exhaust
+	// the server's memory, and decode it.
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxCiphertextLength)
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Reuse the forms.Form validation helpers on the decoded values. The
+	// server can't check the ciphertext itself, only its shape.
+	form := forms.New(url.Values{
+		"ciphertext": []string{input.Ciphertext},
+		"meta":       []string{input.Meta},
+		"expires":    []string{input.Expires},
+	})
+	form.Required("ciphertext", "meta", "expires")
+	form.MaxLength("ciphertext", maxCiphertextLength)
+	form.MatchesPattern("ciphertext", base64URLRX)
+	form.MaxLength("meta", 255)
+	form.PermittedValues("expires", "365", "7", "1")
+	if input.Meta != "" && !json.Valid([]byte(input.Meta)) {
+		form.Errors.Add("meta", "This field is invalid")
+	}
+
+	if !form.Valid() {
+		app.writeJSON(w, r, http.StatusUnprocessableEntity, map[string]interface{}{"errors": form.Errors})
+		return
+	}
+
+	id, err := app.snippets.InsertEncryptedContext(r.Context(), input.Ciphertext, input.Meta, input.Expires, app.authenticatedUser(r).ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.metrics.snippetCreated()
+
+	app.writeJSON(w, r, http.StatusCreated, map[string]interface{}{
+		"id":  id,
+		"url": fmt.Sprintf("/snippet/%d", id),
+	})
+}
+
+func (app *application) showCiphertext(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	c, err := app.snippets.CiphertextContext(r.Context(), id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, c)
+}
+
 func (app *application) signupUserForm(w http.ResponseWriter, r *http.Request) {
 	app.render(w, r, "signup.page.html", &templateData{
 		Form: forms.New(nil),
@@ -256,7 +662,11 @@ func (app *application) signupUser(w http.ResponseWriter, r *http.Request) {
 	form := forms.New(r.PostForm)
 	form.Required("name", "email", "password")
 	form.MatchesPattern("email", forms.EmailRX)
-	form.MinLength("password", 10)
+	err = form.Password("password", app.passwordPolicy, form.Get("name"), form.Get("email"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
 
 	// If there are any errors, redisplay the signup form.
 	if !form.Valid() {
@@ -266,19 +676,22 @@ func (app *application) signupUser(w http.ResponseWriter, r *http.Request) {
 
 	// Try to create a new user record in the database. If the email already exi
 	// add an error message to the form and re-display it.
-	err = app.users.Insert(form.Get("name"), form.Get("email"), form.Get("password"))
+	id, err := app.users.InsertContext(r.Context(), form.Get("name"), form.Get("email"), form.Get("password"))
 	if err == models.ErrDuplicateEmail {
 		form.Errors.Add("email", "Address is already in use")
 		app.render(w, r, "signup.page.html", &templateData{Form: form})
 		return
 	} else if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
+	// Send the new user a link to verify their email address.
+	app.sendVerificationEmail(r.Context(), id, form.Get("name"), form.Get("email"))
+
 	// Otherwise add a confirmation flash message to the session confirming tha
 	// their signup worked and asking them to log in.
-	app.session.Put(r, "flash", "Your signup was successful. Please log in.")
+	app.session.Put(r, "flash", "Your signup was successful. We've emailed you a link to verify your address. Please log in.")
 
 	// And redirect the user to the login page.
 	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
@@ -297,35 +710,1104 @@ func (app *application) loginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	form := forms.New(r.PostForm)
+
+	// Refuse the attempt before doing any (expensive) password hashing if the
+	// client or the account is locked out after too many failures. The
+	// message doesn't say which, or whether the account exists.
+	ipKey, accountKey := loginKeys(r, form.Get("email"))
+	allowed, err := app.loginAllowed(ipKey, accountKey)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !allowed {
+		form.Errors.Add("generic", "Too many failed login attempts. Please try again later.")
+		app.render(w, r, "login.page.html", &templateData{Form: form})
+		return
+	}
+
 	// Check whether the credentials are valid. If they're not, add a generic error
 	// message to the form failures map and re-display the login page.
-	form := forms.New(r.PostForm)
-	id, err := app.users.Authenticate(form.Get("email"), form.Get("password"))
-	if err == models.ErrInvalidCredentials {
+	id, err := app.users.AuthenticateContext(r.Context(), form.Get("email"), form.Get("password"))
+	if err == models.ErrAccountDisabled {
+		form.Errors.Add("generic", "Your account has been disabled")
+		app.render(w, r, "login.page.html", &templateData{Form: form})
+		return
+	} else if err == models.ErrInvalidCredentials {
+		app.metrics.login(false)
+		err = app.loginFailed(r.Context(), ipKey, accountKey)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
 		form.Errors.Add("generic", "Email or Password is incorrect")
 		app.render(w, r, "login.page.html", &templateData{Form: form})
 		return
 	} else if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
-	// Add the ID of the current user to the session, so that they are now 'log
-	// in'.
-	app.session.Put(r, "userID", id)
+	// The login worked, so forget about earlier failures for the account.
+	// Failures from the client's IP are kept, so that one valid account can't
+	// be used to keep trying others.
+	err = app.accountLimiter.Reset(accountKey)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
 
-	// Redirect the user to the create snippet page.
-	http.Redirect(w, r, "/snippet/create", http.StatusSeeOther)
+	user, err := app.users.GetContext(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.finishLogin(w, r, user, form.Get("remember") != "")
 }
 
-func (app *application) logoutUser(w http.ResponseWriter, r *http.Request) {
+// The finishLogin helper logs in a user whose identity has been checked,
+// unless they have two-factor authentication enabled, in which case they are
+// asked for a code first.
+func (app *application) finishLogin(w http.ResponseWriter, r *http.Request, user *models.User, remember bool) {
+	// If the user has two-factor authentication enabled, they aren't logged
+	// in until they've entered a code too. Remember who they are for a few
+	// minutes and ask for it.
+	if user.TOTPEnabled {
+		app.session.Put(r, "twoFactorUserID", user.ID)
+		app.putSessionExpiry(r, "twoFactorExpires", time.Now().Add(twoFactorTimeout))
+		app.session.Put(r, "twoFactorRemember", remember)
+		http.Redirect(w, r, "/user/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	// Add the ID of the current user to the session, so that they are now 'log
+	// in'.
+	err := app.logIn(r, user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.metrics.login(true)
+
+	// If they ticked "remember me", keep them logged in after the session
+	// expires.
+	if remember {
+		err = app.remember(w, r, user.ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	// Redirect the user to the create snippet page.
+	http.Redirect(w, r, "/snippet/create", http.StatusSeeOther)
+}
+
+func (app *application) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFound(w)
+		return
+	}
+
+	// Generate a state to tie the provider's response to this session, a
+	// nonce to tie the ID token to it, and a PKCE verifier to tie the
+	// authorization code to it.
+	state, err := randomToken(16)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	nonce, err := randomToken(16)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	app.session.Put(r, "oidcState", state)
+	app.session.Put(r, "oidcNonce", nonce)
+	app.session.Put(r, "oidcVerifier", verifier)
+	http.Redirect(w, r, app.oidc.authCodeURL(state, nonce, verifier), http.StatusFound)
+}
+
+func (app *application) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFound(w)
+		return
+	}
+
+	// The values from the session are popped, so that each login attempt can
+	// only be completed once.
+	state := app.session.PopString(r, "oidcState")
+	nonce := app.session.PopString(r, "oidcNonce")
+	verifier := app.session.PopString(r, "oidcVerifier")
+
+	q := r.URL.Query()
+	if q.Get("error") != "" {
+		app.session.Put(r, "flash", fmt.Sprintf("Logging in with %s didn't work. Please try again.", app.oidc.name))
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := app.oidc.exchange(r.Context(), q.Get("code"), verifier, nonce)
+	if err != nil {
+		app.logger.WarnContext(r.Context(), "oidc login failed", "error", err)
+		app.metrics.login(false)
+		app.session.Put(r, "flash", fmt.Sprintf("Logging in with %s didn't work. Please try again.", app.oidc.name))
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	userID, err := app.identities.Get(app.oidc.issuer, claims.Subject)
+	if err != nil && err != models.ErrNoRecord {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// If the user is already logged in, they're linking the identity to
+	// their account.
+	if current := app.authenticatedUser(r); current != nil {
+		app.linkIdentity(w, r, current, claims, userID)
+		return
+	}
+
+	if userID == 0 {
+		userID, err = app.identityUser(r.Context(), claims)
+		if err == models.ErrDuplicateIdentity {
+			app.session.Put(r, "flash", fmt.Sprintf("The account with the email address %s is linked to a different %s account.",
+				claims.Email, app.oidc.name))
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		} else if err == models.ErrDuplicateEmail {
+			app.session.Put(r, "flash", fmt.Sprintf("An account with the email address %s already exists. "+
+				"Please log in with your password, then link your %s account from your account page.", claims.Email, app.oidc.name))
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		} else if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	user, err := app.users.GetContext(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if user.Disabled {
+		app.session.Put(r, "flash", "Your account has been disabled.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	app.finishLogin(w, r, user, false)
+}
+
+// The identityUser helper returns the ID of the user to log in for an
+// identity which isn't linked to anyone yet. If both the provider and we have
+// verified the email address of one of our users, the identity is linked to
+// that user. (Both, because otherwise someone could sign up with another
+// person's address and take over their account once they log in.) Otherwise a
+// new user is created along with the identity, which fails with
+// models.ErrDuplicateEmail if the address is in use.
+func (app *application) identityUser(ctx context.Context, claims *oidcClaims) (int, error) {
+	if claims.EmailVerified {
+		user, err := app.users.GetByEmailContext(ctx, claims.Email)
+		if err == nil {
+			user, err = app.users.GetContext(ctx, user.ID)
+		}
+		if err == nil && !user.EmailVerifiedAt.IsZero() {
+			err = app.identities.Insert(app.oidc.issuer, claims.Subject, user.ID)
+			if err != nil {
+				return 0, err
+			}
+			return user.ID, nil
+		} else if err != nil && err != models.ErrNoRecord {
+			return 0, err
+		}
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.Email
+	}
+	return app.users.InsertExternalContext(ctx, name, claims.Email, claims.EmailVerified, app.oidc.issuer, claims.Subject)
+}
+
+// The linkIdentity helper links an identity to the logged in user's account,
+// unless it's already linked to someone.
+func (app *application) linkIdentity(w http.ResponseWriter, r *http.Request, user *models.User, claims *oidcClaims, linkedID int) {
+	switch {
+	case linkedID == user.ID:
+		app.session.Put(r, "flash", fmt.Sprintf("Your %s account is already linked.", app.oidc.name))
+	case linkedID != 0:
+		app.session.Put(r, "flash", fmt.Sprintf("That %s account is linked to another user.", app.oidc.name))
+	default:
+		err := app.identities.Insert(app.oidc.issuer, claims.Subject, user.ID)
+		if err == models.ErrDuplicateIdentity {
+			app.session.Put(r, "flash", fmt.Sprintf("You've already linked a different %s account.", app.oidc.name))
+		} else if err != nil {
+			app.serverError(w, r, err)
+			return
+		} else {
+			app.session.Put(r, "flash", fmt.Sprintf("Your %s account has been linked.", app.oidc.name))
+		}
+	}
+	http.Redirect(w, r, "/user/account", http.StatusSeeOther)
+}
+
+// The twoFactorTimeout constant sets how long a user has to enter their
+// two-factor code after entering their password.
+const twoFactorTimeout = 5 * time.Minute
+
+// The pendingTwoFactorUser method returns the ID of the user who has entered
+// their password and still needs to enter a two-factor code, or zero if
+// there isn't one (or they took too long).
+func (app *application) pendingTwoFactorUser(r *http.Request) int {
+	if time.Now().After(app.sessionExpiry(r, "twoFactorExpires")) {
+		return 0
+	}
+	return app.session.GetInt(r, "twoFactorUserID")
+}
+
+func (app *application) loginTwoFactorForm(w http.ResponseWriter, r *http.Request) {
+	if app.pendingTwoFactorUser(r) == 0 {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "twofactor.page.html", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+func (app *application) loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id := app.pendingTwoFactorUser(r)
+	if id == 0 {
+		app.session.Put(r, "flash", "Your login has timed out. Please log in again.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	if !form.Valid() {
+		app.render(w, r, "twofactor.page.html", &templateData{Form: form})
+		return
+	}
+
+	ok, err := app.verifySecondFactor(r.Context(), id, form.Get("code"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !ok {
+		app.metrics.login(false)
+		form.Errors.Add("code", "Code is incorrect")
+		app.render(w, r, "twofactor.page.html", &templateData{Form: form})
+		return
+	}
+
+	// Only now is the user ID added to the session.
+	app.session.Remove(r, "twoFactorUserID")
+	app.session.Remove(r, "twoFactorExpires")
+	err = app.logIn(r, id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.metrics.login(true)
+	if app.session.PopBool(r, "twoFactorRemember") {
+		err = app.remember(w, r, id)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/snippet/create", http.StatusSeeOther)
+}
+
+func (app *application) logoutUser(w http.ResponseWriter, r *http.Request) {
 	// Remove the userID from the session data so that the user is 'logged out'
-	app.session.Remove(r, "userID")
+	err := app.forget(w, r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.logOut(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
 	// Add a flash message to the session to confirm to the user that they've be
 	app.session.Put(r, "flash", "You've been logged out successfully!")
 	http.Redirect(w, r, "/", 303)
 }
 
-func ping(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("OK"))
+// The passwordResetTTL constant sets how long a password reset link is valid.
+const passwordResetTTL = time.Hour
+
+func (app *application) forgotPasswordForm(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "forgot.page.html", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+func (app *application) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.MatchesPattern("email", forms.EmailRX)
+
+	if !form.Valid() {
+		app.render(w, r, "forgot.page.html", &templateData{Form: form})
+		return
+	}
+
+	// Look up the user and send them a reset link in the background. The
+	// response is the same whether or not the address belongs to an account
+	// (and doesn't wait for the email to be sent), so it can't be used to
+	// find out which addresses are registered. As the lookup runs after the
+	// response has been sent, it uses a context which isn't cancelled when
+	// the request finishes.
+	email := form.Get("email")
+	ctx := context.WithoutCancel(r.Context())
+	app.background(ctx, func() {
+		user, err := app.users.GetByEmailContext(ctx, email)
+		if err == models.ErrNoRecord {
+			return
+		} else if err != nil {
+			app.logger.ErrorContext(ctx, "sending password reset email", "error", err)
+			return
+		}
+
+		token, err := app.tokens.New(user.ID, passwordResetTTL, mysql.ScopePasswordReset)
+		if err != nil {
+			app.logger.ErrorContext(ctx, "sending password reset email", "error", err)
+			return
+		}
+
+		body := fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your Snippetbox account. "+
+			"If it was you, follow the link below within the next hour to choose a new password:\n\n"+
+			"%s/user/password/reset?token=%s\n\nIf it wasn't you, you can ignore this email.\n",
+			user.Name, app.baseURL, url.QueryEscape(token))
+		err = app.mailer.Send(user.Email, "Reset your Snippetbox password", body)
+		if err != nil {
+			app.logger.ErrorContext(ctx, "sending password reset email", "error", err)
+		}
+	})
+
+	app.session.Put(r, "flash", "If an account exists for that address, we've emailed it a link to reset the password.")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+func (app *application) resetPasswordForm(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	// Check the token up front, so that we don't ask for a new password
+	// only to reject it afterwards.
+	ok, err := app.tokens.Check(token, mysql.ScopePasswordReset)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !ok {
+		app.session.Put(r, "flash", "That password reset link is invalid or has expired.")
+		http.Redirect(w, r, "/user/password/forgot", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "reset.page.html", &templateData{
+		Form: forms.New(url.Values{"token": []string{token}}),
+	})
+}
+
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("token", "password")
+
+	// Look up who the token belongs to without redeeming it yet, so that we
+	// can check their new password doesn't contain their name or email
+	// address.
+	owner, err := app.tokens.Owner(form.Get("token"), mysql.ScopePasswordReset)
+	if err == models.ErrNoRecord {
+		app.session.Put(r, "flash", "That password reset link is invalid or has expired.")
+		http.Redirect(w, r, "/user/password/forgot", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	user, err := app.users.GetContext(r.Context(), owner)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = form.Password("password", app.passwordPolicy, user.Name, user.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !form.Valid() {
+		app.render(w, r, "reset.page.html", &templateData{Form: form})
+		return
+	}
+
+	// Redeem the token and set the new password. The token (and any other
+	// reset links which were sent) is only deleted if the password is
+	// changed, so each link only works once, but a failed attempt doesn't
+	// use it up.
+	id, err := app.users.ResetPasswordContext(r.Context(), form.Get("token"), form.Get("password"))
+	if err == models.ErrNoRecord {
+		app.session.Put(r, "flash", "That password reset link is invalid or has expired.")
+		http.Redirect(w, r, "/user/password/forgot", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Revoke all of the user's login sessions. No session has an empty
+	// token, so none of them are kept.
+	err = app.activeSessions.DeleteOthers(id, "")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.rememberTokens.DeleteAllForUser(id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Your password has been reset. Please log in.")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// The emailVerificationTTL constant sets how long an email verification link
+// is valid.
+const emailVerificationTTL = 3 * 24 * time.Hour
+
+// The sendVerificationEmail helper issues a new email verification token for
+// the user and emails them a link to redeem it, in the background. The
+// context is that of the request which asked for it.
+func (app *application) sendVerificationEmail(ctx context.Context, id int, name, email string) {
+	app.background(ctx, func() {
+		token, err := app.tokens.New(id, emailVerificationTTL, mysql.ScopeEmailVerification)
+		if err != nil {
+			app.logger.ErrorContext(ctx, "sending verification email", "error", err)
+			return
+		}
+
+		body := fmt.Sprintf("Hi %s,\n\nPlease follow the link below to verify the email address "+
+			"of your Snippetbox account:\n\n%s/user/verify/confirm?token=%s\n\n"+
+			"The link is valid for three days.\n",
+			name, app.baseURL, url.QueryEscape(token))
+		err = app.mailer.Send(email, "Verify your Snippetbox email address", body)
+		if err != nil {
+			app.logger.ErrorContext(ctx, "sending verification email", "error", err)
+		}
+	})
+}
+
+func (app *application) verifyEmailForm(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "verify.page.html", nil)
+}
+
+func (app *application) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	// Redeem the token. The link may be opened in a different browser to the
+	// one the user is logged in with, so the token alone identifies them.
+	id, err := app.tokens.Use(r.URL.Query().Get("token"), mysql.ScopeEmailVerification)
+	if err == models.ErrNoRecord {
+		app.session.Put(r, "flash", "That verification link is invalid or has expired.")
+		http.Redirect(w, r, "/user/verify", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.users.VerifyEmailContext(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Any other verification links which were sent are no longer needed.
+	err = app.tokens.DeleteAllForUser(id, mysql.ScopeEmailVerification)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Thanks, your email address has been verified!")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) resendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if !user.EmailVerifiedAt.IsZero() {
+		app.session.Put(r, "flash", "Your email address is already verified.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.sendVerificationEmail(r.Context(), user.ID, user.Name, user.Email)
+
+	app.session.Put(r, "flash", fmt.Sprintf("We've sent a new verification link to %s.", user.Email))
+	http.Redirect(w, r, "/user/verify", http.StatusSeeOther)
+}
+
+func (app *application) account(w http.ResponseWriter, r *http.Request) {
+	td := &templateData{}
+
+	// Show whether the user has linked their account with the external
+	// identity provider, if there is one.
+	if app.oidc != nil {
+		issuers, err := app.identities.ForUser(app.authenticatedUser(r).ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		for _, issuer := range issuers {
+			if issuer == app.oidc.issuer {
+				td.IdentityLinked = true
+			}
+		}
+	}
+
+	app.render(w, r, "account.page.html", td)
+}
+
+func (app *application) changePasswordForm(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "password.page.html", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// The new password follows the same rules as at signup. Users who don't
+	// have a password yet can set one this way too.
+	user := app.authenticatedUser(r)
+	form := forms.New(r.PostForm)
+	form.Required("new_password")
+	err = form.Password("new_password", app.passwordPolicy, user.Name, user.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.confirmUser(r, form, "current_password")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !form.Valid() {
+		app.render(w, r, "password.page.html", &templateData{Form: form})
+		return
+	}
+
+	// Changing the password invalidates all of the user's sessions, so log
+	// them in again to keep this one.
+	err = app.users.UpdatePasswordContext(r.Context(), user.ID, form.Get("new_password"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.logIn(r, user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.activeSessions.DeleteOthers(user.ID, app.session.GetString(r, "sessionToken"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Revoke all of the user's "remember me" tokens too, issuing a new one
+	// if this client had one.
+	err = app.rememberTokens.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if _, err := r.Cookie(rememberCookie); err == nil {
+		err = app.remember(w, r, user.ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	app.session.Put(r, "flash", "Your password has been changed. Any other sessions have been logged out.")
+	http.Redirect(w, r, "/user/account", http.StatusSeeOther)
+}
+
+func (app *application) changeEmailForm(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "email.page.html", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+func (app *application) changeEmail(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.MatchesPattern("email", forms.EmailRX)
+	err = app.confirmUser(r, form, "current_password")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !form.Valid() {
+		app.render(w, r, "email.page.html", &templateData{Form: form})
+		return
+	}
+
+	user := app.authenticatedUser(r)
+	err = app.users.UpdateEmailContext(r.Context(), user.ID, form.Get("email"))
+	if err == models.ErrDuplicateEmail {
+		form.Errors.Add("email", "Address is already in use")
+		app.render(w, r, "email.page.html", &templateData{Form: form})
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// The new address needs to be verified. Links sent to the old one were
+	// deleted along with the change.
+	app.sendVerificationEmail(r.Context(), user.ID, user.Name, form.Get("email"))
+
+	app.session.Put(r, "flash", fmt.Sprintf("Your email address has been changed. We've sent a verification link to %s.", form.Get("email")))
+	http.Redirect(w, r, "/user/account", http.StatusSeeOther)
+}
+
+func (app *application) deleteAccountForm(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "delete.page.html", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+func (app *application) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// The user chooses whether their snippets are deleted along with their
+	// account, or kept without an owner.
+	user := app.authenticatedUser(r)
+	form := forms.New(r.PostForm)
+	form.Required("snippets")
+	form.PermittedValues("snippets", "delete", "anonymise")
+
+	err = app.confirmUser(r, form, "password")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !form.Valid() {
+		app.render(w, r, "delete.page.html", &templateData{Form: form})
+		return
+	}
+
+	// Deleting the user removes their login sessions and "remember me"
+	// tokens too, so all that's left is to clear this client's cookies.
+	err = app.users.DeleteContext(r.Context(), user.ID, form.Get("snippets") == "anonymise")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.forget(w, r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.logOut(r)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.logger.InfoContext(r.Context(), "account deleted", "user_id", user.ID)
+
+	app.session.Put(r, "flash", "Your account has been deleted.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) exportAccount(w http.ResponseWriter, r *http.Request) {
+	e, err := app.users.ExportContext(r.Context(), app.authenticatedUser(r).ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Send the export as a file to download, named after the date it was
+	// made. It holds personal data, so it mustn't be cached.
+	filename := fmt.Sprintf("snippetbox-export-%s.json", e.Exported.Format("2006-01-02"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+	app.writeJSON(w, r, http.StatusOK, e)
+}
+
+func (app *application) twoFactorForm(w http.ResponseWriter, r *http.Request) {
+	if app.authenticatedUser(r).TOTPEnabled {
+		app.render(w, r, "totp.page.html", &templateData{Form: forms.New(nil)})
+		return
+	}
+
+	// Generate a new secret and keep it in the session until the user has
+	// proved they've set up their authenticator app by entering a code.
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.session.Put(r, "totpPendingSecret", secret)
+
+	td, err := app.twoFactorEnrollData(r, secret, forms.New(nil))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.render(w, r, "totp.page.html", td)
+}
+
+func (app *application) enableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	secret := app.session.GetString(r, "totpPendingSecret")
+	if user.TOTPEnabled || secret == "" {
+		http.Redirect(w, r, "/user/account/2fa", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	counter, ok := totp.Validate(secret, form.Get("code"), time.Now())
+	if form.Valid() && !ok {
+		form.Errors.Add("code", "Code is incorrect")
+	}
+	if !form.Valid() {
+		td, err := app.twoFactorEnrollData(r, secret, form)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		app.render(w, r, "totp.page.html", td)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(10)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.users.EnableTOTPContext(r.Context(), user.ID, secret, codes)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	// Don't let the code which was just entered be used again.
+	_, err = app.users.UseTOTPCounterContext(r.Context(), user.ID, counter)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.session.Remove(r, "totpPendingSecret")
+
+	// Show the recovery codes. This is the only time they can be seen.
+	app.render(w, r, "recovery.page.html", &templateData{RecoveryCodes: codes})
+}
+
+func (app *application) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if !user.TOTPEnabled {
+		http.Redirect(w, r, "/user/account/2fa", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Turning off two-factor authentication requires the user to confirm
+	// who they are again, with their password (or email address, if they
+	// don't have one) and a code.
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	err = app.confirmUser(r, form, "password")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !form.Valid() {
+		app.render(w, r, "totp.page.html", &templateData{Form: form})
+		return
+	}
+
+	ok, err := app.verifySecondFactor(r.Context(), user.ID, form.Get("code"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !ok {
+		form.Errors.Add("code", "Code is incorrect")
+		app.render(w, r, "totp.page.html", &templateData{Form: form})
+		return
+	}
+
+	err = app.users.DisableTOTPContext(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Two-factor authentication has been turned off.")
+	http.Redirect(w, r, "/user/account", http.StatusSeeOther)
+}
+
+func (app *application) activeSessionsPage(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.activeSessions.ForUser(app.authenticatedUser(r).ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.render(w, r, "sessions.page.html", &templateData{
+		CurrentSession: sessionID(app.session.GetString(r, "sessionToken")),
+		Sessions:       sessions,
+	})
+}
+
+func (app *application) revokeSession(w http.ResponseWriter, r *http.Request) {
+	// Only the user's own sessions can be revoked, so there's no need to
+	// check who the session belongs to first. Any "remember me" token linked
+	// to the session is revoked too, so that it can't log the device back in.
+	userID, id := app.authenticatedUser(r).ID, r.URL.Query().Get(":id")
+	err := app.activeSessions.DeleteByID(userID, id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.rememberTokens.DeleteForSession(userID, id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "The session has been signed out.")
+	http.Redirect(w, r, "/user/account/sessions", http.StatusSeeOther)
+}
+
+func (app *application) revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID, token := app.authenticatedUser(r).ID, app.session.GetString(r, "sessionToken")
+	err := app.activeSessions.DeleteOthers(userID, token)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.rememberTokens.DeleteOthers(userID, sessionID(token))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "All other sessions have been signed out.")
+	http.Redirect(w, r, "/user/account/sessions", http.StatusSeeOther)
+}
+
+func (app *application) adminHome(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/admin/snippets", http.StatusSeeOther)
+}
+
+func (app *application) adminSnippets(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(r.URL.Query())
+
+	s, err := app.snippets.SearchContext(r.Context(), form.Get("q"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.render(w, r, "adminsnippets.page.html", &templateData{
+		Form:     form,
+		Snippets: s,
+	})
+}
+
+func (app *application) adminDeleteSnippet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	err = app.snippets.DeleteContext(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.logger.InfoContext(r.Context(), "admin: snippet deleted", "user_id", app.authenticatedUser(r).ID, "snippet_id", id)
+
+	app.session.Put(r, "flash", fmt.Sprintf("Snippet #%d has been deleted.", id))
+	http.Redirect(w, r, "/admin/snippets", http.StatusSeeOther)
+}
+
+func (app *application) adminUsers(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(r.URL.Query())
+
+	users, err := app.users.SearchContext(r.Context(), form.Get("q"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.render(w, r, "adminusers.page.html", &templateData{
+		Form:  form,
+		Users: users,
+	})
+}
+
+// The canManage function reports whether the actor may disable or delete the
+// target user. Nobody can act on themselves, and only admins can act on
+// other moderators and admins.
+func canManage(actor, target *models.User) bool {
+	if actor.ID == target.ID {
+		return false
+	}
+	return actor.HasRole(models.RoleAdmin) || !target.HasRole(models.RoleModerator)
+}
+
+// The managedUser helper fetches the user identified by the :id URL parameter
+// and checks that the current user may manage them, sending the appropriate
+// error response if not. It returns nil if a response has been sent.
+func (app *application) managedUser(w http.ResponseWriter, r *http.Request) *models.User {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return nil
+	}
+
+	target, err := app.users.GetContext(r.Context(), id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return nil
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return nil
+	}
+
+	if !canManage(app.authenticatedUser(r), target) {
+		app.clientError(w, http.StatusForbidden)
+		return nil
+	}
+	return target
+}
+
+func (app *application) adminDisableUser(w http.ResponseWriter, r *http.Request) {
+	target := app.managedUser(w, r)
+	if target == nil {
+		return
+	}
+
+	err := app.users.SetDisabledContext(r.Context(), target.ID, true)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Log the user out everywhere, so that they can't carry on.
+	err = app.activeSessions.DeleteOthers(target.ID, "")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.rememberTokens.DeleteAllForUser(target.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.logger.InfoContext(r.Context(), "admin: user disabled", "user_id", app.authenticatedUser(r).ID, "target_id", target.ID)
+
+	app.session.Put(r, "flash", fmt.Sprintf("%s has been disabled.", target.Name))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func (app *application) adminEnableUser(w http.ResponseWriter, r *http.Request) {
+	target := app.managedUser(w, r)
+	if target == nil {
+		return
+	}
+
+	err := app.users.SetDisabledContext(r.Context(), target.ID, false)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.logger.InfoContext(r.Context(), "admin: user enabled", "user_id", app.authenticatedUser(r).ID, "target_id", target.ID)
+
+	app.session.Put(r, "flash", fmt.Sprintf("%s has been enabled.", target.Name))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func (app *application) adminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	target := app.managedUser(w, r)
+	if target == nil {
+		return
+	}
+
+	err := app.users.DeleteContext(r.Context(), target.ID, false)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.logger.InfoContext(r.Context(), "admin: user deleted", "user_id", app.authenticatedUser(r).ID, "target_id", target.ID)
+
+	app.session.Put(r, "flash", fmt.Sprintf("%s has been deleted.", target.Name))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
 }
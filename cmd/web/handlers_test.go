@@ -1,45 +1,451 @@
 package main
 
 import (
-	"io/ioutil"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
 
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"snippetbox/pkg/forms"
+	"snippetbox/pkg/models"
+	"snippetbox/pkg/models/mysql"
+	"snippetbox/pkg/passwords"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golangcollege/sessions"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func TestPing(t *testing.T) {
-	// Initialize a new httptest.ResponseRecorder.
+func TestCreateEncryptedSnippetValidation(t *testing.T) {
+	// Invalid input is rejected before the database is touched, so we can
+	// use an application without any models.
+	app := &application{}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantFields []string
+	}{
+		{
+			name:       "Malformed JSON",
+			body:       `{"ciphertext":`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Missing fields",
+			body:       `{}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"ciphertext", "meta", "expires"},
+		},
+		{
+			name:       "Invalid values",
+			body:       `{"ciphertext":"not base64!","meta":"{","expires":"30"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"ciphertext", "meta", "expires"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "/api/snippet/encrypted", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			app.createEncryptedSnippet(rr, r)
+
+			rs := rr.Result()
+			if rs.StatusCode != tt.wantStatus {
+				t.Errorf("want %d; got %d", tt.wantStatus, rs.StatusCode)
+			}
+			if len(tt.wantFields) == 0 {
+				return
+			}
+
+			var body struct {
+				Errors map[string][]string `json:"errors"`
+			}
+			defer rs.Body.Close()
+			if err := json.NewDecoder(rs.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			for _, field := range tt.wantFields {
+				if len(body.Errors[field]) == 0 {
+					t.Errorf("want an error for %q", field)
+				}
+			}
+		})
+	}
+}
+
+func TestUnlockSnippet(t *testing.T) {
+	db, mock := newMockDB(t)
+	app := &application{
+		session:        sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+		snippets:       &mysql.SnippetModel{DB: db},
+		unlockAttempts: newThrottle(5, time.Minute),
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("open sesame"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snippet := &models.Snippet{ID: 1, HashedPassword: hashedPassword}
+
+	mock.ExpectQuery("SELECT (.+) FROM snippets").WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "title", "content", "created", "expires", "user_id", "private", "hashed_password", "encrypted"}).
+			AddRow(1, "Locked", "Secret", time.Now(), time.Now().Add(time.Hour), 0, false, hashedPassword, false),
+	)
+	mock.ExpectQuery("SELECT hashed_password FROM snippets").WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"hashed_password"}).AddRow(hashedPassword),
+	)
+
+	// Unlock the snippet through session.Enable, so that the session is
+	// saved (and so encoded) just like it is for real requests.
 	rr := httptest.NewRecorder()
+	app.session.Enable(http.HandlerFunc(app.unlockSnippet)).ServeHTTP(rr,
+		postForm("/snippet/1/unlock?:id=1", url.Values{"password": {"open sesame"}}))
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("want %d; got %d", http.StatusSeeOther, rr.Code)
+	}
+	if got := rr.Header().Get("Location"); got != "/snippet/1" {
+		t.Errorf("want redirect to %q; got %q", "/snippet/1", got)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("want session cookie; got none")
+	}
+
+	// The snippet is unlocked on the next request with the session cookie,
+	// but not without it.
+	var unlocked bool
+	check := app.session.Enable(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unlocked = app.unlocked(r, snippet)
+	}))
+
+	r := httptest.NewRequest("GET", "/snippet/1", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	check.ServeHTTP(httptest.NewRecorder(), r)
+	if !unlocked {
+		t.Error("want snippet unlocked with the session cookie")
+	}
+
+	check.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/snippet/1", nil))
+	if unlocked {
+		t.Error("want snippet locked without the session cookie")
+	}
+}
 
-	// Initialize a new dummy http.Request.
-	r, err := http.NewRequest("GET", "/", nil)
+func TestDeleteAccountWithoutPassword(t *testing.T) {
+	cache, err := newTemplateCache("../../ui/html/")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Call the ping handler function, passing in the
-	// httptest.ResponseRecorder and http.Request.
-	ping(rr, r)
+	// The user signed up through an identity provider, so they confirm by
+	// typing their email address rather than a password.
+	user := &models.User{ID: 1, Name: "Alice", Email: "alice@example.com"}
 
-	// Call the Result() method on the http.ResponseRecorder to get the
-	// http.Response generated by the ping handler.
-	rs := rr.Result()
+	tests := []struct {
+		name       string
+		confirm    string
+		wantStatus int
+		wantBody   string
+	}{
+		{"Missing", "", http.StatusOK, "This field cannot be blank"},
+		{"Wrong address", "bob@example.com", http.StatusOK, "This doesn&#39;t match your email address"},
+		{"Matching address", " Alice@Example.com ", http.StatusSeeOther, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			app := &application{
+				activeSessions: newMemorySessions(),
+				logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+				session:        sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+				templateCache:  cache,
+				users:          &mysql.UserModel{DB: db},
+			}
+			if tt.wantStatus == http.StatusSeeOther {
+				mock.ExpectBegin()
+				for i := 0; i < 13; i++ {
+					mock.ExpectExec("DELETE|UPDATE").WillReturnResult(sqlmock.NewResult(0, 0))
+				}
+				mock.ExpectCommit()
+			}
+
+			r := postForm("/user/account/delete", url.Values{"snippets": {"delete"}, "confirm": {tt.confirm}})
+			r = sessions.MockRequest(r.WithContext(context.WithValue(r.Context(), contextKeyUser, user)))
+			rr := httptest.NewRecorder()
+			app.deleteAccount(rr, r)
 
-	// We can then examine the http.Response to check that the status code
-	// written by the ping handler was 200.
-	if rs.StatusCode != http.StatusOK {
-		t.Errorf("want %d; got %d", http.StatusOK, rs.StatusCode)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("want %d; got %d", tt.wantStatus, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("want body to contain %q", tt.wantBody)
+			}
+		})
 	}
+}
+
+func TestResetPassword(t *testing.T) {
+	user := &models.User{ID: 1, Name: "Alice", Email: "alice@example.com", HasPassword: true}
+
+	tests := []struct {
+		name       string
+		tokenRows  *sqlmock.Rows
+		updateErr  error
+		wantStatus int
+		wantPath   string
+	}{
+		{
+			name:       "Success",
+			tokenRows:  sqlmock.NewRows([]string{"user_id"}).AddRow(1),
+			wantStatus: http.StatusSeeOther,
+			wantPath:   "/user/login",
+		},
+		{
+			// The link was redeemed already, for example by a concurrent
+			// request which got the lock on the token first.
+			name:       "Used link",
+			tokenRows:  sqlmock.NewRows([]string{"user_id"}),
+			wantStatus: http.StatusSeeOther,
+			wantPath:   "/user/password/forgot",
+		},
+		{
+			// If the password can't be changed, the transaction is rolled
+			// back, so the token isn't used up and the link can be tried
+			// again.
+			name:       "Update fails",
+			tokenRows:  sqlmock.NewRows([]string{"user_id"}).AddRow(1),
+			updateErr:  errors.New("lock wait timeout"),
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			app := &application{
+				activeSessions: newMemorySessions(),
+				logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+				passwordPolicy: forms.DefaultPasswordPolicy,
+				rememberTokens: &mockRememberStore{tokens: map[string]*models.RememberToken{}},
+				session:        sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+				tokens:         &mysql.TokenModel{DB: db},
+				users: &mysql.UserModel{
+					DB:        db,
+					Passwords: &passwords.Hasher{Algorithm: passwords.Bcrypt, BcryptCost: bcrypt.MinCost},
+				},
+			}
+
+			mock.ExpectQuery("SELECT user_id FROM tokens").WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+			mock.ExpectQuery("SELECT (.+) FROM users").WithArgs(user.ID).WillReturnRows(mockUserRows(user))
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT user_id FROM tokens (.+) FOR UPDATE").
+				WithArgs(sqlmock.AnyArg(), mysql.ScopePasswordReset).
+				WillReturnRows(tt.tokenRows)
+			switch {
+			case tt.wantPath == "/user/password/forgot":
+				mock.ExpectRollback()
+			case tt.updateErr != nil:
+				mock.ExpectExec("UPDATE users SET hashed_password").WillReturnError(tt.updateErr)
+				mock.ExpectRollback()
+			default:
+				mock.ExpectExec("UPDATE users SET hashed_password").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM tokens").
+					WithArgs(1, mysql.ScopePasswordReset).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
 
-	// And we can check that the response body written by the ping handler
-	// equals "OK".
-	defer rs.Body.Close()
-	body, err := ioutil.ReadAll(rs.Body)
+			r := postForm("/user/password/reset", url.Values{"token": {"abc"}, "password": {"correct horse battery staple"}})
+			r = sessions.MockRequest(r)
+			rr := httptest.NewRecorder()
+			app.resetPassword(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("want %d; got %d", tt.wantStatus, rr.Code)
+			}
+			if got := rr.Header().Get("Location"); got != tt.wantPath {
+				t.Errorf("want redirect to %q; got %q", tt.wantPath, got)
+			}
+		})
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	cheap := &passwords.Hasher{Algorithm: passwords.Bcrypt, BcryptCost: bcrypt.MinCost}
+	hash, err := cheap.Hash("pa$$word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: 1, Name: "Alice", Email: "alice@example.com", HasPassword: true}
+
+	db, mock := newMockDB(t)
+	mailer := &mockMailer{sent: make(chan string, 1)}
+	app := &application{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		mailer:  mailer,
+		session: sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+		tokens:  &mysql.TokenModel{DB: db},
+		users:   &mysql.UserModel{DB: db, Passwords: cheap},
+	}
+
+	mock.ExpectQuery("SELECT id, hashed_password, disabled FROM users").
+		WithArgs(user.Email).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hashed_password", "disabled"}).AddRow(user.ID, hash, false))
+
+	// Links sent to the old address stop working along with the change,
+	// including password reset links, which would otherwise let it take the
+	// account back.
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET email").
+		WithArgs("alice@example.org", user.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM tokens").
+		WithArgs(user.ID, mysql.ScopeEmailVerification, mysql.ScopePasswordReset).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	// A verification link is sent to the new address.
+	mock.ExpectExec("INSERT INTO tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	r := postForm("/user/account/email", url.Values{"email": {"alice@example.org"}, "current_password": {"pa$$word"}})
+	r = sessions.MockRequest(r.WithContext(context.WithValue(r.Context(), contextKeyUser, user)))
+	rr := httptest.NewRecorder()
+	app.changeEmail(rr, r)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("want %d; got %d", http.StatusSeeOther, rr.Code)
+	}
+	select {
+	case to := <-mailer.sent:
+		if to != "alice@example.org" {
+			t.Errorf("want verification email to %q; got %q", "alice@example.org", to)
+		}
+	case <-time.After(time.Second):
+		t.Error("want verification email sent")
+	}
+}
+
+func TestChangeEmailWithoutPassword(t *testing.T) {
+	cache, err := newTemplateCache("../../ui/html/")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if string(body) != "OK" {
-		t.Errorf("want body to equal %q", "OK")
+
+	// The user signed up through an identity provider, so they confirm by
+	// typing their current email address rather than a password.
+	user := &models.User{ID: 1, Name: "Alice", Email: "alice@example.com"}
+
+	tests := []struct {
+		name       string
+		confirm    string
+		wantStatus int
+		wantBody   string
+	}{
+		{"Missing", "", http.StatusOK, "This field cannot be blank"},
+		{"Wrong address", "alice@example.org", http.StatusOK, "This doesn&#39;t match your email address"},
+		{"Matching address", " Alice@Example.com ", http.StatusSeeOther, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			mailer := &mockMailer{sent: make(chan string, 1)}
+			app := &application{
+				logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+				mailer:        mailer,
+				session:       sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+				templateCache: cache,
+				tokens:        &mysql.TokenModel{DB: db},
+				users:         &mysql.UserModel{DB: db},
+			}
+			if tt.wantStatus == http.StatusSeeOther {
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE users SET email").
+					WithArgs("alice@example.org", user.ID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+				mock.ExpectExec("INSERT INTO tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			r := postForm("/user/account/email", url.Values{"email": {"alice@example.org"}, "confirm": {tt.confirm}})
+			r = sessions.MockRequest(r.WithContext(context.WithValue(r.Context(), contextKeyUser, user)))
+			rr := httptest.NewRecorder()
+			app.changeEmail(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("want %d; got %d", tt.wantStatus, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("want body to contain %q", tt.wantBody)
+			}
+			if tt.wantStatus == http.StatusSeeOther {
+				select {
+				case <-mailer.sent:
+				case <-time.After(time.Second):
+					t.Error("want verification email sent")
+				}
+				return
+			}
+
+			// The form asks for the email address, and not for a password.
+			if body := rr.Body.String(); strings.Contains(body, "current_password") || !strings.Contains(body, "name='confirm'") {
+				t.Error("want the form to ask for the email address instead of the password")
+			}
+		})
+	}
+}
+
+func TestSetPasswordWithoutPassword(t *testing.T) {
+	user := &models.User{ID: 1, Name: "Alice", Email: "alice@example.com"}
+
+	db, mock := newMockDB(t)
+	app := &application{
+		activeSessions: newMemorySessions(),
+		logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		passwordPolicy: forms.DefaultPasswordPolicy,
+		rememberTokens: &mockRememberStore{tokens: map[string]*models.RememberToken{}},
+		session:        sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+		users: &mysql.UserModel{
+			DB:        db,
+			Passwords: &passwords.Hasher{Algorithm: passwords.Bcrypt, BcryptCost: bcrypt.MinCost},
+		},
+	}
+
+	// A user without a password sets one by confirming their email address,
+	// and stays logged in.
+	mock.ExpectExec("UPDATE users SET hashed_password").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").WithArgs(user.ID).WillReturnRows(mockUserRows(
+		&models.User{ID: user.ID, Name: user.Name, Email: user.Email, HasPassword: true, SessionVersion: 2},
+	))
+
+	r := postForm("/user/account/password", url.Values{"confirm": {"alice@example.com"}, "new_password": {"correct horse battery staple"}})
+	r = sessions.MockRequest(r.WithContext(context.WithValue(r.Context(), contextKeyUser, user)))
+	rr := httptest.NewRecorder()
+	app.changePassword(rr, r)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("want %d; got %d", http.StatusSeeOther, rr.Code)
+	}
+	if got := app.session.GetInt(r, "sessionVersion"); got != 2 {
+		t.Errorf("want session version 2; got %d", got)
 	}
 }
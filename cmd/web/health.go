@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// The pinger interface describes a database connection which can be pinged
+// to check that it answers. It is satisfied by *sql.DB.
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// The readyzTimeout constant sets how long the readiness check waits for the
+// database to answer.
+const readyzTimeout = 2 * time.Second
+
+// The healthz handler is the liveness check. If the server can answer at all
+// it's alive, so it always reports that it's OK.
+func (app *application) healthz(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// The readyz handler is the readiness check, which reports whether the server
+// can usefully handle requests: the database must answer a ping, the
+// templates must be loaded and the server mustn't be shutting down. The
+// result of each check is included in the response, and if any of them fail
+// the status code is 503 Service Unavailable. The statistics of the database
+// connection pool aren't included, as they're exported as metrics on the
+// admin listener instead.
+func (app *application) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"database":  "ok",
+		"templates": "ok",
+		"shutdown":  "ok",
+	}
+
+	if app.db == nil {
+		checks["database"] = "not configured"
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), readyzTimeout)
+		defer cancel()
+		// The endpoint is public, so the error (which may name the
+		// database's address) is only logged.
+		if err := app.db.PingContext(ctx); err != nil {
+			app.logger.WarnContext(r.Context(), "readiness check: database ping failed", "error", err)
+			checks["database"] = "unavailable"
+		}
+	}
+	if len(app.templateCache) == 0 {
+		checks["templates"] = "not loaded"
+	}
+	if app.shuttingDown.Load() {
+		checks["shutdown"] = "shutting down"
+	}
+
+	status, code := "ok", http.StatusOK
+	for _, result := range checks {
+		if result != "ok" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+
+	app.writeJSON(w, r, code, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
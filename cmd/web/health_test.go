@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The mockPinger type is a pinger which returns the given error.
+type mockPinger struct {
+	err error
+}
+
+func (m *mockPinger) PingContext(ctx context.Context) error {
+	return m.err
+}
+
+func TestHealthz(t *testing.T) {
+	app := &application{}
+
+	rr := httptest.NewRecorder()
+	app.healthz(rr, httptest.NewRequest("GET", "/healthz", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, rr.Code)
+	}
+	if body := rr.Body.String(); body != `{"status":"ok"}` {
+		t.Errorf("want body %q; got %q", `{"status":"ok"}`, body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	templates := map[string]*template.Template{"home.page.html": template.New("home")}
+
+	tests := []struct {
+		name         string
+		db           pinger
+		templates    map[string]*template.Template
+		shuttingDown bool
+		wantStatus   int
+		wantChecks   map[string]string
+	}{
+		{
+			name:       "Ready",
+			db:         &mockPinger{},
+			templates:  templates,
+			wantStatus: http.StatusOK,
+			wantChecks: map[string]string{"database": "ok", "templates": "ok", "shutdown": "ok"},
+		},
+		{
+			name:       "Database down",
+			db:         &mockPinger{err: errors.New("connection refused")},
+			templates:  templates,
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"database": "unavailable", "templates": "ok", "shutdown": "ok"},
+		},
+		{
+			name:       "No templates",
+			db:         &mockPinger{},
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"database": "ok", "templates": "not loaded", "shutdown": "ok"},
+		},
+		{
+			name:         "Shutting down",
+			db:           &mockPinger{},
+			templates:    templates,
+			shuttingDown: true,
+			wantStatus:   http.StatusServiceUnavailable,
+			wantChecks:   map[string]string{"database": "ok", "templates": "ok", "shutdown": "shutting down"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{
+				db:            tt.db,
+				logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+				templateCache: tt.templates,
+			}
+			app.shuttingDown.Store(tt.shuttingDown)
+
+			rr := httptest.NewRecorder()
+			app.readyz(rr, httptest.NewRequest("GET", "/readyz", nil))
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("want %d; got %d", tt.wantStatus, rr.Code)
+			}
+
+			var body struct {
+				Status string            `json:"status"`
+				Checks map[string]string `json:"checks"`
+				Pool   interface{}       `json:"database_pool"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantStatus := "ok"
+			if tt.wantStatus != http.StatusOK {
+				wantStatus = "unavailable"
+			}
+			if body.Status != wantStatus {
+				t.Errorf("want status %q; got %q", wantStatus, body.Status)
+			}
+			for check, want := range tt.wantChecks {
+				if body.Checks[check] != want {
+					t.Errorf("want %s check %q; got %q", check, want, body.Checks[check])
+				}
+			}
+
+			// The statistics of the connection pool aren't given out to the
+			// public.
+			if body.Pool != nil {
+				t.Errorf("want no pool stats; got %v", body.Pool)
+			}
+		})
+	}
+}
@@ -2,23 +2,88 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"path/filepath"
+	"runtime"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/justinas/nosurf"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"snippetbox/pkg/forms"
 	"snippetbox/pkg/models"
 )
 
-// The serveError helper writes an error message and stack trace to the errorLog
-// then sends a generic 500 Internal Server Error response to the user.
-func (app *application) serverError(w http.ResponseWriter, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	// app.errorLog.Println(trace)
-	app.errorLog.Output(2, trace)
+// The serveError helper logs an error message, along with the file and line
+// it was called from and the stack trace as attributes, then sends the user a
+// 500 Internal Server Error page showing the request's ID. Errors from
+// database queries which ran out of time get a 503 Service Unavailable page
+// instead, as the database is busy rather than broken, and the request can
+// be tried again later.
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	_, file, line, _ := runtime.Caller(1)
+	app.logger.ErrorContext(r.Context(), err.Error(),
+		"source", fmt.Sprintf("%s:%d", filepath.Base(file), line),
+		"stack", string(debug.Stack()),
+	)
 
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if errors.Is(err, context.DeadlineExceeded) {
+		app.errorPage(w, r, http.StatusServiceUnavailable)
+		return
+	}
+	app.errorPage(w, r, http.StatusInternalServerError)
+}
+
+// The errorPage helper sends an error page with the given status code showing
+// the request's ID, which users can quote when they report the problem. It
+// doesn't use render, which reports its own errors through serverError, and
+// it falls back to plain text if the page can't be shown.
+func (app *application) errorPage(w http.ResponseWriter, r *http.Request, status int) {
+	id := requestID(r.Context())
+
+	if ts, ok := app.templateCache["error.page.html"]; ok {
+		buf := new(bytes.Buffer)
+		err := ts.Execute(buf, &templateData{
+			CSPNonce:    cspNonce(r.Context()),
+			CurrentYear: time.Now().Year(),
+			GoogleFonts: app.securityPolicy != nil && app.securityPolicy.GoogleFonts,
+			RequestID:   id,
+		})
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(status)
+			buf.WriteTo(w)
+			return
+		}
+	}
+
+	http.Error(w, fmt.Sprintf("%s\nRequest ID: %s", http.StatusText(status), id), status)
+}
+
+// The background helper runs a function in a new goroutine, so that slow work
+// (like sending an email) doesn't hold up the response. Any panic in the
+// function is recovered and logged rather than bringing down the server. The
+// context is that of the request which started the work, and is only used to
+// tag the log entry.
+func (app *application) background(ctx context.Context, fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.ErrorContext(ctx, fmt.Sprintf("%s", err), "stack", string(debug.Stack()))
+			}
+		}()
+
+		fn()
+	}()
 }
 
 // The clientError helper sends a specific status code and corresponding description
@@ -34,6 +99,20 @@ func (app *application) notFound(w http.ResponseWriter) {
 	app.clientError(w, http.StatusNotFound)
 }
 
+// The writeJSON helper encodes the data as JSON and sends it to the user with
+// the given status code.
+func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
 // Create an addDefaultData helper. This takes a pointer to a templateData
 // struct, adds the current year to the CurrentYear field, and then returns
 // the pointer. Again, we're not using the *http.Request parameter at the
@@ -43,10 +122,19 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 		td = &templateData{}
 	}
 
-	// Add the CSRF token to the templateData struct.
+	// Add the CSRF token to the templateData struct, and the nonce which
+	// scripts need to carry to be allowed by the Content-Security-Policy.
 	td.CSRFToken = nosurf.Token(r)
+	td.CSPNonce = cspNonce(r.Context())
+	td.GoogleFonts = app.securityPolicy != nil && app.securityPolicy.GoogleFonts
 	td.AuthenticateUser = app.authenticatedUser(r)
 	td.CurrentYear = time.Now().Year()
+	// Add whether users can sign up with a password, and the name of the
+	// external identity provider they can log in with, if any.
+	td.LocalSignup = app.localSignup
+	if app.oidc != nil {
+		td.OIDCName = app.oidc.name
+	}
 	// Add the flash message to the template data, if one exists.
 	td.Flash = app.session.PopString(r, "flash")
 	return td
@@ -58,7 +146,7 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, name stri
 	// provided name, call the serverError helper method that we made earlier.
 	ts, ok := app.templateCache[name]
 	if !ok {
-		app.serverError(w, fmt.Errorf("The template %s does not exist", name))
+		app.serverError(w, r, fmt.Errorf("The template %s does not exist", name))
 		return
 	}
 
@@ -70,9 +158,19 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, name stri
 	// err := ts.Execute(buf, td)
 	// Execute the template set, passing the dynamic data with the current
 	// year injected.
+	// The time taken is recorded in the metrics, and in a span of the
+	// request's trace.
+	_, span := startSpan(r.Context(), "render "+name, trace.WithAttributes(attribute.String("template", name)))
+	start := time.Now()
 	err := ts.Execute(buf, app.addDefaultData(td, r))
+	app.metrics.observeRender(name, time.Since(start))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -84,10 +182,51 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, name stri
 	// // Execute the template set, passing in any dynamic data.
 	// err := ts.Execute(w, td)
 	// if err != nil {
-	// 	app.serverError(w, err)
+	// 	app.serverError(w, r, err)
 	// }
 }
 
+// The logIn method records in the session that the user with the given ID is
+// logged in, along with their current session version. It also starts a new
+// server-side login session, replacing any existing one for this client.
+func (app *application) logIn(r *http.Request, id int) error {
+	user, err := app.users.GetContext(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	if token := app.session.GetString(r, "sessionToken"); token != "" {
+		err = app.activeSessions.Delete(token)
+		if err != nil {
+			return err
+		}
+	}
+	token, err := app.activeSessions.Create(user.ID, clientIP(r), r.UserAgent(), app.session.Lifetime)
+	if err != nil {
+		return err
+	}
+
+	app.session.Put(r, "userID", user.ID)
+	app.session.Put(r, "sessionVersion", user.SessionVersion)
+	app.session.Put(r, "sessionToken", token)
+	return nil
+}
+
+// The logOut method removes the user's login details from the session and
+// revokes the server-side login session.
+func (app *application) logOut(r *http.Request) error {
+	if token := app.session.GetString(r, "sessionToken"); token != "" {
+		err := app.activeSessions.Delete(token)
+		if err != nil {
+			return err
+		}
+	}
+	app.session.Remove(r, "userID")
+	app.session.Remove(r, "sessionVersion")
+	app.session.Remove(r, "sessionToken")
+	return nil
+}
+
 // The authenticatedUser method returns the ID of the current user from the
 // session, or zero if the request is from an unauthenticated user.
 func (app *application) authenticatedUser(r *http.Request) *models.User {
@@ -97,3 +236,163 @@ func (app *application) authenticatedUser(r *http.Request) *models.User {
 	}
 	return user
 }
+
+// The confirmUser method checks that the current user has confirmed a change
+// to their account, adding any problems to the form's errors. Users confirm
+// with their password, in the given field. Those who signed up through an
+// external identity provider don't have one, so they type their email address
+// in the "confirm" field instead. The password is only checked once the rest
+// of the form is valid.
+func (app *application) confirmUser(r *http.Request, form *forms.Form, passwordField string) error {
+	user := app.authenticatedUser(r)
+	if !user.HasPassword {
+		form.Required("confirm")
+		if confirm := form.Get("confirm"); confirm != "" && !strings.EqualFold(strings.TrimSpace(confirm), user.Email) {
+			form.Errors.Add("confirm", "This doesn't match your email address")
+		}
+		return nil
+	}
+
+	form.Required(passwordField)
+	if !form.Valid() {
+		return nil
+	}
+	_, err := app.users.AuthenticateContext(r.Context(), user.Email, form.Get(passwordField))
+	if err == models.ErrInvalidCredentials {
+		form.Errors.Add(passwordField, "Password is incorrect")
+		return nil
+	}
+	return err
+}
+
+// The canView method reports whether the current user is allowed to see a
+// snippet. Public snippets are visible to everyone, while private ones are
+// only visible to the user who created them.
+func (app *application) canView(r *http.Request, s *models.Snippet) bool {
+	if !s.Private {
+		return true
+	}
+	user := app.authenticatedUser(r)
+	return user != nil && user.ID == s.UserID
+}
+
+// The unlockLifetime constant sets how long a password-protected snippet stays
+// unlocked in the session once the correct password has been entered.
+const unlockLifetime = 30 * time.Minute
+
+// The unlockSessionKey function returns the session key under which the
+// unlock expiry time for a snippet is stored.
+func unlockSessionKey(id int) string {
+	return fmt.Sprintf("unlocked:%d", id)
+}
+
+// The unlocked method reports whether the current user may see the content of
+// a snippet. Snippets without a password are always unlocked, as are those
+// created by the current user. Otherwise the snippet must have been unlocked
+// in the session recently.
+func (app *application) unlocked(r *http.Request, s *models.Snippet) bool {
+	if s.HashedPassword == nil {
+		return true
+	}
+	if user := app.authenticatedUser(r); user != nil && user.ID == s.UserID {
+		return true
+	}
+	return time.Now().Before(app.sessionExpiry(r, unlockSessionKey(s.ID)))
+}
+
+// The putSessionExpiry method stores an expiry time in the session. The
+// session data is encoded with gob, which can't encode a time.Time held in an
+// interface{} unless it's been registered, so we store it as a Unix time (an
+// int64) instead.
+func (app *application) putSessionExpiry(r *http.Request, key string, t time.Time) {
+	app.session.Put(r, key, t.Unix())
+}
+
+// The sessionExpiry method returns an expiry time stored in the session with
+// putSessionExpiry. If there isn't one, it returns the zero time, which has
+// always passed.
+func (app *application) sessionExpiry(r *http.Request, key string) time.Time {
+	unix, ok := app.session.Get(r, key).(int64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
+
+// The clientIP function returns the IP address of the client which made the
+// request, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// The renderSnippet helper loads the stars and comments for a snippet and
+// renders the show page, passing in the given comment form.
+func (app *application) renderSnippet(w http.ResponseWriter, r *http.Request, s *models.Snippet, form *forms.Form) {
+	// Count the stars on the snippet and, if the user is logged in, check
+	// whether they have starred it themselves so we can show the right button.
+	var err error
+	s.Stars, err = app.stars.Count(s.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	var starred bool
+	if user := app.authenticatedUser(r); user != nil {
+		starred, err = app.stars.Exists(user.ID, s.ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	// The total doesn't include views which haven't been flushed yet.
+	s.Views, err = app.viewStats.Total(s.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	comments, err := app.comments.ForSnippet(s.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.render(w, r, "show.page.html", &templateData{
+		Comments: comments,
+		Form:     form,
+		Snippet:  s,
+		Starred:  starred,
+	})
+}
+
+// The authoredComment helper fetches the comment named by the ":id" URL
+// parameter and checks that it was written by the current user. If not, an
+// appropriate error response is sent and false is returned.
+func (app *application) authoredComment(w http.ResponseWriter, r *http.Request) (*models.Comment, bool) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return nil, false
+	}
+
+	c, err := app.comments.Get(id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return nil, false
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	if c.UserID != app.authenticatedUser(r).ID {
+		app.clientError(w, http.StatusForbidden)
+		return nil, false
+	}
+
+	return c, true
+}
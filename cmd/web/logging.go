@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The newLogger function creates a structured logger which writes to out in
+// the given format ("text" or "json"), discarding anything below the given
+// level ("debug", "info", "warn" or "error"). Entries logged with a request's
+// context are tagged with its ID and the ID of its trace.
+func newLogger(out io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(requestIDHandler{slog.NewTextHandler(out, opts)}), nil
+	case "json":
+		return slog.New(requestIDHandler{slog.NewJSONHandler(out, opts)}), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// The requestIDHandler type wraps a slog.Handler, adding the ID of the
+// request (if any) from the context of each entry as the "request_id"
+// attribute, and the ID of the trace it's part of (if it's being traced) as
+// the "trace_id" attribute.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// The contextKeyRequestLog key holds the *responseRecorder of the request
+// being logged, so that the authenticate middleware can record who made it.
+var contextKeyRequestLog = contextKey("requestLog")
+
+// The logRequestUser function records the ID of the user who made a request
+// in its access log entry.
+func logRequestUser(r *http.Request, userID int) {
+	if rw, ok := r.Context().Value(contextKeyRequestLog).(*responseRecorder); ok {
+		rw.userID = userID
+	}
+}
+
+// The responseRecorder type wraps a http.ResponseWriter to record what we
+// need for the access log: the status code and size of the response, the
+// pattern of the route the request matched, and the ID of the user who made
+// it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+	route  string
+	userID int
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.size += n
+	return n, err
+}
+
+// The Unwrap method lets http.ResponseController reach the original
+// http.ResponseWriter.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
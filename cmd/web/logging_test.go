@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		level   string
+		wantErr bool
+		// wantInfo is the start of the output for an info message, or
+		// empty if the message should be discarded.
+		wantInfo string
+	}{
+		{name: "Text", format: "text", level: "info", wantInfo: "time="},
+		{name: "JSON", format: "json", level: "info", wantInfo: `{"time":`},
+		{name: "Warn level", format: "json", level: "warn"},
+		{name: "Debug level", format: "text", level: "DEBUG", wantInfo: "time="},
+		{name: "Unknown format", format: "xml", level: "info", wantErr: true},
+		{name: "Unknown level", format: "text", level: "loud", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := newLogger(&buf, tt.format, tt.level)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			logger.Info("hello", "key", "value")
+			if !strings.HasPrefix(buf.String(), tt.wantInfo) || (tt.wantInfo == "") != (buf.Len() == 0) {
+				t.Errorf("want output starting %q; got %q", tt.wantInfo, buf.String())
+			}
+		})
+	}
+}
+
+func TestServerError(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := newTemplateCache("../../ui/html/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		templateCache map[string]*template.Template
+		err           error
+		wantCode      int
+		wantBody      string
+	}{
+		{"Error page", cache, errors.New("something broke"), http.StatusInternalServerError, "<code>abc123</code>"},
+		{"Plain text", nil, errors.New("something broke"), http.StatusInternalServerError, "Request ID: abc123"},
+		{"Query timeout", cache, fmt.Errorf("something broke: %w", context.DeadlineExceeded), http.StatusServiceUnavailable, "<code>abc123</code>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			app := &application{logger: logger, templateCache: tt.templateCache}
+
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), contextKeyRequestID, "abc123"))
+			app.serverError(rr, r, tt.err)
+
+			// The user is shown the request ID, so that they can quote it.
+			// Queries which timed out are reported as 503 Service
+			// Unavailable rather than 500 Internal Server Error.
+			if rr.Code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("want body to contain %q; got %q", tt.wantBody, rr.Body.String())
+			}
+
+			// The error is logged with the request ID, the stack trace and
+			// the place serverError was called from as attributes.
+			var entry map[string]string
+			err = json.Unmarshal(buf.Bytes(), &entry)
+			if err != nil {
+				t.Fatalf("%v: %s", err, buf.String())
+			}
+			if entry["level"] != "ERROR" || entry["msg"] != tt.err.Error() {
+				t.Errorf("want ERROR %q; got %s %q", tt.err.Error(), entry["level"], entry["msg"])
+			}
+			if entry["request_id"] != "abc123" {
+				t.Errorf("want request ID %q; got %q", "abc123", entry["request_id"])
+			}
+			if !strings.HasPrefix(entry["source"], "logging_test.go:") {
+				t.Errorf("want source in logging_test.go; got %q", entry["source"])
+			}
+			if !strings.Contains(entry["stack"], "runtime/debug.Stack") {
+				t.Errorf("want stack trace; got %q", entry["stack"])
+			}
+		})
+	}
+}
@@ -1,19 +1,29 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"snippetbox/pkg/forms"
+	"snippetbox/pkg/mailer"
 	"snippetbox/pkg/models/mysql"
+	"snippetbox/pkg/passwords"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/golangcollege/sessions"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type contextKey string
@@ -26,15 +36,46 @@ var contextKeyUser = contextKey("user")
 // Add a snippets field to the application struct. This will allow us to
 // make the SnippetModel object available to our handlers.
 type application struct {
-	errorLog      *log.Logger
-	infoLog       *log.Logger
-	session       *sessions.Session
-	snippets      *mysql.SnippetModel
-	templateCache map[string]*template.Template
-	users         *mysql.UserModel
+	accountLimiter       *loginLimiter
+	activeSessions       sessionStore
+	baseURL              string
+	comments             *mysql.CommentModel
+	db                   pinger
+	identities           *mysql.IdentityModel
+	ipLimiter            *loginLimiter
+	localSignup          bool
+	logger               *slog.Logger
+	mailer               mailer.Mailer
+	metrics              *metrics
+	oidc                 *oidcProvider
+	passwordPolicy       *forms.PasswordPolicy
+	rememberTokens       rememberStore
+	requireVerifiedEmail bool
+	securityPolicy       *securityPolicy
+	session              *sessions.Session
+	shuttingDown         atomic.Bool
+	snippets             *mysql.SnippetModel
+	stars                *mysql.StarModel
+	templateCache        map[string]*template.Template
+	tokens               *mysql.TokenModel
+	tracerProvider       trace.TracerProvider
+	unlockAttempts       *throttle
+	users                *mysql.UserModel
+	views                *viewCounter
+	viewStats            *mysql.ViewModel
 }
 
 func main() {
+	// The "user" command manages users from the command line instead of
+	// starting the web server.
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		err := runUserCommand(&userCommand{args: os.Args[2:], out: os.Stdout, openDB: openUserModel})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// Define a new command-line flag with the name "addr", a default value of ":8000",
 	// and some short help text explaining what the flag controls. The value of the
@@ -42,13 +83,111 @@ func main() {
 	addr := flag.String("addr", ":8000", "http network address")
 
 	// Define a new command-line flag for the MySQL DSN string.
-	dsn := flag.String("dsn", "fei:fei@tcp(172.20.0.2)/snippetbox?parseTime=true", "MySQL data")
+	dsn := flag.String("dsn", defaultDSN, "MySQL data")
+
+	// Define a new command-line flag for how long each query for snippets
+	// and users may run. Queries are also cancelled when the client making
+	// the request goes away.
+	queryTimeout := flag.Duration("query-timeout", 5*time.Second, "Time limit for each snippet and user query (no limit if 0)")
+
+	// Define new command-line flags to tune the database connection pool,
+	// and to choose how many times we try to connect to the database at
+	// startup before giving up.
+	dbMaxOpenConns := flag.Int("db-max-open-conns", 25, "Maximum number of open database connections")
+	dbMaxIdleConns := flag.Int("db-max-idle-conns", 25, "Maximum number of idle database connections")
+	dbConnMaxLifetime := flag.Duration("db-conn-max-lifetime", time.Hour, "Maximum time a database connection may be reused (no limit if 0)")
+	dbConnMaxIdleTime := flag.Duration("db-conn-max-idle-time", 15*time.Minute, "Maximum time a database connection may be idle (no limit if 0)")
+	dbConnectAttempts := flag.Int("db-connect-attempts", 10, "Number of times to try connecting to the database at startup")
+	dbConnectBackoff := flag.Duration("db-connect-backoff", 500*time.Millisecond, "Time to wait after the first failed attempt to connect to the database, doubling after each one")
+	dbConnectTimeout := flag.Duration("db-connect-timeout", 5*time.Second, "Time to wait for the database to answer each attempt to connect to it")
 
 	// Define a new command-line flag for the session secret (a random key whic
 	// will be used to encrypt and authenticate session cookies). It should be
 	// bytes long.
 	secret := flag.String("secret", "s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge", "Secret key")
 
+	// Define a new command-line flag for the URL the application is reached
+	// at, which is used to build the links we send in emails.
+	baseURL := flag.String("base-url", "https://localhost:8000", "Base URL for links in emails")
+
+	// Define new command-line flags to choose how emails are sent. The "log"
+	// mailer writes them to stdout (or to the file given by -mail-log)
+	// instead of sending them, which is handy during development.
+	mailerType := flag.String("mailer", "log", "Mailer to send emails with (log or smtp)")
+	mailLog := flag.String("mail-log", "", "File to write emails to with the log mailer (default stdout)")
+	smtpHost := flag.String("smtp-host", "localhost", "SMTP host")
+	smtpPort := flag.Int("smtp-port", 25, "SMTP port")
+	smtpUsername := flag.String("smtp-username", "", "SMTP username")
+	smtpPassword := flag.String("smtp-password", "", "SMTP password")
+	sender := flag.String("sender", "Snippetbox <no-reply@snippetbox.local>", "Sender address for emails")
+
+	// Define a new command-line flag for the email verification policy. When
+	// it's set, users who haven't verified their email address can still log
+	// in but can't create snippets.
+	requireVerifiedEmail := flag.Bool("require-verified-email", true, "Only allow users with a verified email address to create snippets")
+
+	// Define a new command-line flag to choose where failed login attempts
+	// are recorded. The "memory" store only works for a single instance; use
+	// "mysql" to share lockouts between several.
+	loginStore := flag.String("login-store", "memory", "Store for failed login attempts (memory or mysql)")
+
+	// Define a new command-line flag to choose where the server-side records
+	// of login sessions are kept. The "memory" store loses them (logging
+	// everyone out) when the application restarts.
+	sessionStoreType := flag.String("session-store", "mysql", "Store for login sessions (mysql or memory)")
+
+	// Define new command-line flags to let users log in with an external
+	// OpenID Connect provider, like a company identity provider. It's
+	// enabled by setting the issuer URL. Local signup with a password can be
+	// disabled, so that new users have to come through the provider.
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL (disabled if empty)")
+	oidcClientID := flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcClientSecret := flag.String("oidc-client-secret", "", "OpenID Connect client secret")
+	oidcName := flag.String("oidc-name", "SSO", "Name of the OpenID Connect provider shown to users")
+	localSignup := flag.Bool("local-signup", true, "Allow users to sign up with a password")
+
+	// Define new command-line flags for the password hashing policy. When
+	// the policy changes, existing hashes are upgraded as users log in.
+	passwordHash := flag.String("password-hash", passwords.Bcrypt, "Password hashing algorithm (bcrypt or argon2id)")
+	bcryptCost := flag.Int("bcrypt-cost", passwords.Default.BcryptCost, "bcrypt cost")
+	argon2Memory := flag.Uint("argon2-memory", uint(passwords.DefaultArgon2.Memory), "argon2id memory in KiB")
+	argon2Time := flag.Uint("argon2-time", uint(passwords.DefaultArgon2.Time), "argon2id iterations")
+	argon2Threads := flag.Uint("argon2-threads", uint(passwords.DefaultArgon2.Threads), "argon2id parallelism")
+
+	// Define a new command-line flag for an offline copy of a breached
+	// password dataset, which new passwords are checked against.
+	breachedPasswords := flag.String("breached-passwords", "", "Directory of the breached password dataset, split by SHA-1 hash prefix (optional)")
+
+	// Define a new command-line flag for the network address of the admin
+	// listener, which serves the Prometheus metrics. It's separate from the
+	// main listener so that it doesn't have to be exposed to users.
+	adminAddr := flag.String("admin-addr", "localhost:9090", "Admin network address for metrics (disabled if empty)")
+
+	// Define new command-line flags for graceful shutdown: how long the
+	// readiness check fails before the server stops accepting connections,
+	// and how long in-flight requests then have to finish.
+	shutdownDelay := flag.Duration("shutdown-delay", 5*time.Second, "Time to fail readiness checks before shutting down")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 20*time.Second, "Time to wait for requests to finish when shutting down")
+
+	// Define new command-line flags to choose the format of the logs ("text"
+	// or "json") and the lowest level which is logged.
+	logFormat := flag.String("log-format", "text", "Log format (text or json)")
+	logLevel := flag.String("log-level", "info", "Log level (debug, info, warn or error)")
+
+	// Define new command-line flags to choose where traces are exported:
+	// "stdout" writes them to stdout, and "otlp" sends them to an
+	// OpenTelemetry collector at the given endpoint.
+	traceExporter := flag.String("trace-exporter", "none", "Trace exporter (none, stdout or otlp)")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint URL for traces (default from OTEL_EXPORTER_OTLP_ENDPOINT)")
+
+	// Define new command-line flags for the security headers: whether the
+	// Google Fonts the pages link to are allowed, how long browsers should
+	// remember to only use HTTPS, and whether the Content-Security-Policy is
+	// only reported on rather than enforced.
+	googleFonts := flag.Bool("google-fonts", true, "Load fonts from Google Fonts")
+	hstsMaxAge := flag.Duration("hsts-max-age", 365*24*time.Hour, "Max age for Strict-Transport-Security (disabled if 0)")
+	cspReportOnly := flag.Bool("csp-report-only", false, "Report Content-Security-Policy violations without blocking them")
+
 	// Importantly, we use the flag.Parse() function to parse the command-line
 	// This reads in the command-line flag value and assigns it to the addr variable.
 	// You need to call this *before* you use the addr variable
@@ -56,24 +195,49 @@ func main() {
 	// during parsing the application will be terminated.
 	flag.Parse()
 
-	// Use log.new() to create a logger for writing information messages. This
-	// three parameters: the destination to write the logs to (os.Stdout), a String
-	// prefix for message (INFO followed by a tab), and flags to indicate what
-	// additional information to include (local date and time). Note that the flags
-	// are joined using the bitwise OR operator (|).
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	// Use the newLogger() function to create a structured logger for writing
+	// both information and error messages to stdout, in the format and at the
+	// level chosen on the command line.
+	logger, err := newLogger(os.Stdout, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// The fatal function logs an error and exits, like log.Fatal() does.
+	fatal := func(err error) {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
 
-	// Create a logger for writing error messages in the same way, but use Stderr
-	// as the destination and use the log.Lshortfile flag to include the relevant
-	// file and line number.
-	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	// Initialize the tracer provider chosen on the command line. It's made
+	// the global one, so that the SQL queries made through openDB() are
+	// traced with it too.
+	tp, err := newTracerProvider(context.Background(), *traceExporter, *otlpEndpoint, os.Stdout)
+	if err != nil {
+		fatal(err)
+	}
+	var tracerProvider trace.TracerProvider
+	if tp != nil {
+		otel.SetTracerProvider(tp)
+		tracerProvider = tp
+	}
+	otel.SetTextMapPropagator(propagator)
 
 	// To keep the main() function tidy I've put the code for creating a connection
-	// pool into the separate openDB() function below. We pass openDB() the DSN
-	// from the command-line flag.
-	db, err := openDB(*dsn)
+	// pool into the separate openDB() function. We pass openDB() the DSN and
+	// the pool settings from the command-line flags.
+	db, err := openDB(*dsn, dbConfig{
+		maxOpenConns:    *dbMaxOpenConns,
+		maxIdleConns:    *dbMaxIdleConns,
+		connMaxLifetime: *dbConnMaxLifetime,
+		connMaxIdleTime: *dbConnMaxIdleTime,
+		connectAttempts: *dbConnectAttempts,
+		connectBackoff:  *dbConnectBackoff,
+		connectTimeout:  *dbConnectTimeout,
+	}, logger)
 	if err != nil {
-		errorLog.Fatal(err)
+		fatal(err)
 	}
 
 	// Use the sessions.New() function to initialize a new session manager,
@@ -89,20 +253,149 @@ func main() {
 	// Initialize a new template cache...
 	templateCache, err := newTemplateCache("./ui/html/")
 	if err != nil {
-		errorLog.Fatal(err)
+		fatal(err)
+	}
+
+	// Initialize the mailer chosen on the command line.
+	var m mailer.Mailer
+	switch *mailerType {
+	case "smtp":
+		m = &mailer.SMTP{
+			Host:     *smtpHost,
+			Port:     *smtpPort,
+			Username: *smtpUsername,
+			Password: *smtpPassword,
+			Sender:   *sender,
+		}
+	case "log":
+		out := os.Stdout
+		if *mailLog != "" {
+			out, err = os.OpenFile(*mailLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				fatal(err)
+			}
+			defer out.Close()
+		}
+		m = &mailer.Log{Out: out, Sender: *sender}
+	default:
+		fatal(fmt.Errorf("unknown mailer %q", *mailerType))
+	}
+
+	// Initialize the store for failed login attempts.
+	var attempts attemptStore
+	switch *loginStore {
+	case "memory":
+		attempts = newMemoryAttempts(loginWindow)
+	case "mysql":
+		attempts = &mysql.LoginAttemptModel{DB: db}
+	default:
+		fatal(fmt.Errorf("unknown login store %q", *loginStore))
+	}
+
+	// Initialize the password hashing policy.
+	hasher := &passwords.Hasher{
+		Algorithm:  *passwordHash,
+		BcryptCost: *bcryptCost,
+		Argon2: passwords.Argon2Params{
+			Memory:     uint32(*argon2Memory),
+			Time:       uint32(*argon2Time),
+			Threads:    uint8(*argon2Threads),
+			SaltLength: passwords.DefaultArgon2.SaltLength,
+			KeyLength:  passwords.DefaultArgon2.KeyLength,
+		},
+	}
+	err = hasher.Validate()
+	if err != nil {
+		fatal(err)
+	}
+
+	// Initialize the policy for new passwords, using the breached password
+	// dataset if there is one.
+	passwordPolicy := forms.DefaultPasswordPolicy
+	if *breachedPasswords != "" {
+		breached, err := forms.LoadBreachedPasswords(*breachedPasswords)
+		if err != nil {
+			fatal(err)
+		}
+		passwordPolicy = &forms.PasswordPolicy{
+			MinLength:  forms.DefaultPasswordPolicy.MinLength,
+			MinEntropy: forms.DefaultPasswordPolicy.MinEntropy,
+			Breached:   breached,
+		}
+	}
+
+	// Initialize the store for login sessions.
+	var activeSessions sessionStore
+	switch *sessionStoreType {
+	case "mysql":
+		activeSessions = &mysql.SessionModel{DB: db}
+	case "memory":
+		activeSessions = newMemorySessions()
+	default:
+		fatal(fmt.Errorf("unknown session store %q", *sessionStoreType))
+	}
+
+	// Fetch the configuration of the OpenID Connect provider, if there is
+	// one. Its redirect URL is our callback route.
+	var oidcProv *oidcProvider
+	if *oidcIssuer != "" {
+		if *oidcClientID == "" {
+			fatal(errors.New("-oidc-client-id is required with -oidc-issuer"))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		oidcProv, err = newOIDCProvider(ctx, *oidcName, *oidcIssuer, *oidcClientID, *oidcClientSecret, *baseURL+"/user/login/oidc/callback")
+		cancel()
+		if err != nil {
+			fatal(err)
+		}
 	}
 
 	// Initialize a mysql.SnippetModel instance and add it to the application
-	// dependencies.
+	// dependencies. Wrong guesses at a snippet's password are throttled to five
+	// per client every 15 minutes. Logins are locked out after 5 failures for
+	// an account, or 20 from a single IP address.
 	app := &application{
-		errorLog:      errorLog,
-		infoLog:       infoLog,
-		session:       session,
-		snippets:      &mysql.SnippetModel{DB: db},
-		templateCache: templateCache,
-		users:         &mysql.UserModel{DB: db},
+		accountLimiter:       newLoginLimiter(attempts, 5),
+		activeSessions:       activeSessions,
+		baseURL:              *baseURL,
+		comments:             &mysql.CommentModel{DB: db},
+		db:                   db,
+		identities:           &mysql.IdentityModel{DB: db},
+		ipLimiter:            newLoginLimiter(attempts, 20),
+		localSignup:          *localSignup,
+		logger:               logger,
+		mailer:               m,
+		metrics:              newMetrics(db),
+		oidc:                 oidcProv,
+		passwordPolicy:       passwordPolicy,
+		rememberTokens:       &mysql.RememberTokenModel{DB: db},
+		requireVerifiedEmail: *requireVerifiedEmail,
+		securityPolicy: &securityPolicy{
+			GoogleFonts: *googleFonts,
+			HSTSMaxAge:  *hstsMaxAge,
+			ReportOnly:  *cspReportOnly,
+		},
+		session:        session,
+		snippets:       &mysql.SnippetModel{DB: db, Passwords: hasher, Timeout: *queryTimeout},
+		stars:          &mysql.StarModel{DB: db},
+		templateCache:  templateCache,
+		tokens:         &mysql.TokenModel{DB: db},
+		tracerProvider: tracerProvider,
+		unlockAttempts: newThrottle(5, 15*time.Minute),
+		users:          &mysql.UserModel{DB: db, Passwords: hasher, Timeout: *queryTimeout, Logger: logger},
+		views:          newViewCounter(&mysql.ViewModel{DB: db}),
+		viewStats:      &mysql.ViewModel{DB: db},
 	}
 
+	// Start a background goroutine which flushes the snippet view counts
+	// to the database every minute. Closing stopFlusher stops it after a
+	// final flush, and it closes flusherStopped once that's done.
+	stopFlusher, flusherStopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		app.runViewFlusher(time.Minute, stopFlusher)
+		close(flusherStopped)
+	}()
+
 	// Initialize a tls.Config struct to hold the non-default TLS settings we want
 	// the server to use.
 	tlsConfig := &tls.Config{
@@ -112,36 +405,89 @@ func main() {
 
 	// Initialize a new http.Server struct. We set the Addr and Handler fields
 	// that the server uses the same network address and routes as before. and
-	// the ErrorLog field so that the server now uses the custom errorLog logger
-	// the event of any problems
+	// the ErrorLog field so that the server's own errors are written by our
+	// structured logger at the error level.
 	srv := &http.Server{
-		Addr:     *addr,
-		ErrorLog: errorLog,
-		Handler:  app.routes(), // Call the new app.routes() method
+		Addr:      *addr,
+		ErrorLog:  slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		Handler:   app.routes(), // Call the new app.routes() method
 		TLSConfig: tlsConfig,
 	}
 
+	// Start the admin listener in the background. It serves plain HTTP, as
+	// it should only be reachable from inside our network.
+	var adminSrv *http.Server
+	if *adminAddr != "" {
+		adminSrv = &http.Server{
+			Addr:     *adminAddr,
+			ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
+			Handler:  app.adminRoutes(),
+		}
+		go func() {
+			logger.Info("starting admin server", "addr", *adminAddr)
+			err := adminSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				fatal(err)
+			}
+		}()
+	}
+
+	// Shut down gracefully when we receive a SIGINT or SIGTERM signal. First
+	// the readiness check starts failing, and we wait for the shutdown delay
+	// so that load balancers notice and stop sending us new requests. Then
+	// the servers stop accepting connections and wait (up to the shutdown
+	// timeout) for in-flight requests to finish.
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		<-ctx.Done()
+		stop()
+
+		logger.Info("shutting down server", "delay", *shutdownDelay)
+		app.shuttingDown.Store(true)
+		time.Sleep(*shutdownDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if adminSrv != nil {
+			defer adminSrv.Shutdown(ctx)
+		}
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
 	// The value returned from the flag.String() function is a pointer to the flag
 	// value, not the value itself. So we need to dereference the pointer(i.e.
 	// prefix it with the * symbol) before using it.
-	infoLog.Printf("Starting server on %s", *addr)
+	logger.Info("starting server", "addr", *addr)
 	// err = srv.ListenAndServe()
 	// Use the ListenAndServeTLS() method to start the HTTPS server. We
 	// pass in the paths to the TLS certificate and corresponding private key a
 	// the two parameters.
+	// It returns http.ErrServerClosed as soon as the shutdown starts, after
+	// which we wait for it to finish and for the view counts to be flushed.
 	err = srv.ListenAndServeTLS("./tls/cert.pem", "./tls/key.pem")
-	errorLog.Fatal(err)
-}
-
-// The openDB() function wraps sql.Open() and returns a sql.DB connection pool
-// for a given DSN.
-func openDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("mysql", dsn)
+	if !errors.Is(err, http.ErrServerClosed) {
+		fatal(err)
+	}
+	// Even if the in-flight requests didn't all finish in time, stop the
+	// flusher and wait for it to write the last view counts before giving
+	// up, so that they aren't lost.
+	err = <-shutdownErr
+	close(stopFlusher)
+	<-flusherStopped
 	if err != nil {
-		return nil, err
+		fatal(err)
 	}
-	if err = db.Ping(); err != nil {
-		return nil, err
+
+	// Export any spans which are still buffered.
+	if tp != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		err = tp.Shutdown(ctx)
+		if err != nil {
+			fatal(err)
+		}
 	}
-	return db, nil
+
+	logger.Info("stopped server")
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bmizerany/pat"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The metrics type holds the Prometheus metrics we record, in their own
+// registry. Its methods do nothing on a nil *metrics, so handlers can be
+// tested without one.
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	renderDuration  *prometheus.HistogramVec
+	snippetsCreated prometheus.Counter
+	logins          *prometheus.CounterVec
+	panics          prometheus.Counter
+}
+
+// The newMetrics function creates and registers our metrics, along with the
+// standard Go runtime and process metrics. If db isn't nil, the statistics of
+// its connection pool are exported too.
+func newMetrics(db *sql.DB) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "snippetbox_http_requests_total",
+			Help: "Number of HTTP requests handled, by method, route pattern and status code.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "snippetbox_http_request_duration_seconds",
+			Help:    "Time taken to handle HTTP requests, by method and route pattern.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		renderDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "snippetbox_template_render_duration_seconds",
+			Help:    "Time taken to render HTML templates, by template name.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1},
+		}, []string{"template"}),
+		snippetsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "snippetbox_snippets_created_total",
+			Help: "Number of snippets created.",
+		}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "snippetbox_logins_total",
+			Help: "Number of login attempts, by result (success or failure).",
+		}, []string{"result"}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "snippetbox_panics_recovered_total",
+			Help: "Number of panics recovered while handling requests.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.renderDuration,
+		m.snippetsCreated,
+		m.logins,
+		m.panics,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	if db != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(db, "snippetbox"))
+	}
+
+	// Start the login counters at zero, so that rates can be calculated
+	// from the first one.
+	m.logins.WithLabelValues("success")
+	m.logins.WithLabelValues("failure")
+
+	return m
+}
+
+// The handler method returns a http.Handler which serves the metrics in the
+// Prometheus text format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// The observeRequest method records a handled request. Requests which didn't
+// match a route are recorded with the route "unmatched", so that scanners
+// trying lots of paths don't create lots of metrics.
+func (m *metrics) observeRequest(method, route string, status int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	if route == "" {
+		route = "unmatched"
+	}
+	m.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	m.requestDuration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// The observeRender method records the time taken to render a template.
+func (m *metrics) observeRender(name string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.renderDuration.WithLabelValues(name).Observe(duration.Seconds())
+}
+
+// The snippetCreated method counts a new snippet.
+func (m *metrics) snippetCreated() {
+	if m == nil {
+		return
+	}
+	m.snippetsCreated.Inc()
+}
+
+// The login method counts a login attempt which succeeded or failed.
+func (m *metrics) login(success bool) {
+	if m == nil {
+		return
+	}
+	if success {
+		m.logins.WithLabelValues("success").Inc()
+	} else {
+		m.logins.WithLabelValues("failure").Inc()
+	}
+}
+
+// The panicRecovered method counts a panic recovered by recoverPanic.
+func (m *metrics) panicRecovered() {
+	if m == nil {
+		return
+	}
+	m.panics.Inc()
+}
+
+// The routeMux type wraps pat's router so that each request's access log
+// entry, metrics and trace record the pattern of the route it matched (like
+// "/snippet/:id"), rather than the path.
+type routeMux struct {
+	*pat.PatternServeMux
+}
+
+// Get registers a handler for GET (and HEAD) requests matching the pattern.
+func (m routeMux) Get(pattern string, h http.Handler) {
+	m.PatternServeMux.Get(pattern, withRoute(pattern, h))
+}
+
+// Post registers a handler for POST requests matching the pattern.
+func (m routeMux) Post(pattern string, h http.Handler) {
+	m.PatternServeMux.Post(pattern, withRoute(pattern, h))
+}
+
+// The withRoute function wraps a handler to record the route pattern it was
+// registered for in the request's access log entry and its trace.
+func withRoute(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rw, ok := r.Context().Value(contextKeyRequestLog).(*responseRecorder); ok {
+			rw.route = pattern
+		}
+		traceRoute(r, pattern)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The adminRoutes method returns the routes served on the separate admin
+// listener, which isn't exposed to users: the metrics and the health checks.
+func (app *application) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", app.metrics.handler())
+	mux.HandleFunc("/healthz", app.healthz)
+	mux.HandleFunc("/readyz", app.readyz)
+	return mux
+}
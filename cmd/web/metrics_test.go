@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/pat"
+)
+
+func TestMetrics(t *testing.T) {
+	app := &application{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: newMetrics(nil),
+	}
+
+	// Route some requests through the access log middleware, which records
+	// them in the metrics, including one which panics.
+	mux := routeMux{pat.New()}
+	mux.Get("/snippet/:id", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	mux.Get("/panic", app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	})))
+	handler := app.logRequest(mux)
+
+	for _, path := range []string{"/snippet/1", "/snippet/2", "/panic", "/wp-login.php"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	app.metrics.observeRender("home.page.html", time.Millisecond)
+	app.metrics.snippetCreated()
+	app.metrics.login(true)
+	app.metrics.login(false)
+	app.metrics.login(false)
+
+	// Scrape the metrics from the admin routes.
+	rr := httptest.NewRecorder()
+	app.adminRoutes().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rr.Code)
+	}
+	body := rr.Body.String()
+
+	for _, want := range []string{
+		`snippetbox_http_requests_total{method="GET",route="/snippet/:id",status="200"} 2`,
+		`snippetbox_http_requests_total{method="GET",route="/panic",status="500"} 1`,
+		`snippetbox_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`snippetbox_http_request_duration_seconds_count{method="GET",route="/snippet/:id"} 2`,
+		`snippetbox_template_render_duration_seconds_count{template="home.page.html"} 1`,
+		`snippetbox_snippets_created_total 1`,
+		`snippetbox_logins_total{result="success"} 1`,
+		`snippetbox_logins_total{result="failure"} 2`,
+		`snippetbox_panics_recovered_total 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want metrics to contain %q", want)
+		}
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	// Recording metrics without any configured doesn't panic.
+	var m *metrics
+	m.observeRequest("GET", "/", http.StatusOK, time.Second)
+	m.observeRender("home.page.html", time.Second)
+	m.snippetCreated()
+	m.login(true)
+	m.panicRecovered()
+}
@@ -4,25 +4,80 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"regexp"
 	"snippetbox/pkg/models"
+	"time"
 
 	"github.com/justinas/nosurf"
 )
 
-func secureHeaders(next http.Handler) http.Handler {
+// The contextKeyRequestID key holds the ID of the request.
+var contextKeyRequestID = contextKey("requestID")
+
+// The requestIDRX regular expression matches the request IDs we accept from
+// clients (or from a proxy in front of us).
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// The setRequestID middleware gives each request an ID, which is sent back in
+// the X-Request-ID response header and added to every log entry about the
+// request. If the request already has a valid X-Request-ID header (for
+// example, one set by a load balancer) we use its ID, so that the logs can be
+// correlated; otherwise a random one is generated.
+func setRequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("X-XSS-Protection", "1; mode=block")
-		w.Header().Set("X-Frame-Options", "deny")
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			var err error
+			id, err = randomToken(12)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
 
-		next.ServeHTTP(w, r)
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), contextKeyRequestID, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// The requestID function returns the ID of the request from its context, or
+// an empty string if it doesn't have one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(contextKeyRequestID).(string)
+	return id
+}
+
+// The logRequest middleware writes an access log entry for each request once
+// it has been handled, recording the route it matched, the status code and
+// size of the response, how long it took, and the ID of the user who made it
+// (or zero if they weren't logged in). The request is recorded in the
+// metrics too.
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.infoLog.Printf("%s - %s %s %s", r.RemoteAddr, r.Proto, r.Method, r.URL)
+		start := time.Now()
+		rw := &responseRecorder{ResponseWriter: w}
+		ctx := context.WithValue(r.Context(), contextKeyRequestLog, rw)
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		// Handlers which don't write anything send a 200 OK response.
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		duration := time.Since(start)
+		app.metrics.observeRequest(r.Method, rw.route, rw.status, duration)
+		app.logger.InfoContext(r.Context(), "request",
+			"ip", r.RemoteAddr,
+			"proto", r.Proto,
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+			"route", rw.route,
+			"status", rw.status,
+			"size", rw.size,
+			"duration", duration,
+			"user_id", rw.userID,
+		)
 	})
 }
 
@@ -36,9 +91,10 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 			if err := recover(); err != nil {
 				// Set a "Connection: close" header on the response.
 				w.Header().Set("Connection", "close")
+				app.metrics.panicRecovered()
 				// Call the app.serverError helper method to return a 500
 				// Internal Server response.
-				app.serverError(w, fmt.Errorf("%s", err))
+				app.serverError(w, r, fmt.Errorf("%s", err))
 			}
 		}()
 
@@ -60,6 +116,41 @@ func (app *application) requireAuthenticatedUser(next http.Handler) http.Handler
 	})
 }
 
+// The requireRole method returns a middleware which only lets users with the
+// given role (or a more privileged one) through. Anyone else gets a 403
+// Forbidden response, apart from unauthenticated users, who are redirected to
+// the login page like requireAuthenticatedUser does.
+func (app *application) requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.authenticatedUser(r)
+			if user == nil {
+				http.Redirect(w, r, "/user/login", 302)
+				return
+			}
+			if !user.HasRole(role) {
+				app.clientError(w, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// The requireVerifiedUser middleware stops users who haven't verified their
+// email address from going any further, if the application is configured to
+// require it. It must come after requireAuthenticatedUser in the chain.
+func (app *application) requireVerifiedUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.requireVerifiedEmail && app.authenticatedUser(r).EmailVerifiedAt.IsZero() {
+			app.session.Put(r, "flash", "Please verify your email address first.")
+			http.Redirect(w, r, "/user/verify", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Create a NoSurf middleware function which uses a customized CSRF cookie with
 // the Secure, Path and HttpOnly flags set.
 func noSurf(next http.Handler) http.Handler {
@@ -76,22 +167,79 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check if a userID value exists in the session. If this *isn't
 		// present* then call the next handler in the chain as normal.
+		// If it isn't present, try to log the user in from their "remember
+		// me" cookie first.
 		exists := app.session.Exists(r, "userID")
 		if !exists {
-			next.ServeHTTP(w, r)
-			return
+			id, err := app.restoreSession(w, r)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			if id == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// If the request was served under the login session of a
+			// concurrent request, nothing was saved in its session, and
+			// the login session has been checked already.
+			if !app.session.Exists(r, "userID") {
+				user, err := app.users.GetContext(r.Context(), id)
+				if err == models.ErrNoRecord || (err == nil && user.Disabled) {
+					next.ServeHTTP(w, r)
+					return
+				} else if err != nil {
+					app.serverError(w, r, err)
+					return
+				}
+				ctx := context.WithValue(r.Context(), contextKeyUser, user)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
 		}
 
 		// Fetch the details of the current user from the database. If
 		// no matching record is found, remove the (invalid) userID from
 		// their session and call the next handler in the chain as normal.
-		user, err := app.users.Get(app.session.GetInt(r, "userID"))
+		user, err := app.users.GetContext(r.Context(), app.session.GetInt(r, "userID"))
 		if err == models.ErrNoRecord {
 			app.session.Remove(r, "userID")
 			next.ServeHTTP(w, r)
 			return
 		} else if err != nil {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
+			return
+		}
+
+		// If the user's password has changed since this session was
+		// started, the session is no longer valid, so log them out.
+		if app.session.GetInt(r, "sessionVersion") != user.SessionVersion {
+			app.session.Remove(r, "userID")
+			app.session.Remove(r, "sessionVersion")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// If the user's account has been disabled, log them out.
+		if user.Disabled {
+			app.session.Remove(r, "userID")
+			app.session.Remove(r, "sessionVersion")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Likewise, if the server-side login session has been revoked (or
+		// has expired), log them out.
+		current, err := app.currentSession(r)
+		if err == models.ErrNoRecord || (err == nil && current.UserID != user.ID) {
+			app.session.Remove(r, "userID")
+			app.session.Remove(r, "sessionVersion")
+			app.session.Remove(r, "sessionToken")
+			next.ServeHTTP(w, r)
+			return
+		} else if err != nil {
+			app.serverError(w, r, err)
 			return
 		}
 
@@ -101,6 +249,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// call the next handler in the chain *using this new copy of the
 		// request*.
 		ctx := context.WithValue(r.Context(), contextKeyUser, user)
+		logRequestUser(r, user.ID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"snippetbox/pkg/models"
 )
 
 func TestSecureHeaders(t *testing.T) {
@@ -16,8 +24,11 @@ func TestSecureHeaders(t *testing.T) {
 	}
 
 	// Create a mock HTTP handler that we can pass to our secureHeaders
-	// middleware, which writes a 200 status code and "OK" response body.
+	// middleware, which writes a 200 status code and "OK" response body. It
+	// records the CSP nonce the middleware added to the request's context.
+	var nonce string
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = cspNonce(r.Context())
 		w.Write([]byte("OK"))
 	})
 
@@ -25,7 +36,8 @@ func TestSecureHeaders(t *testing.T) {
 	// secureHeaders *returns* a http.Handler we can call its ServeHTTP()
 	// method, passing in the http.ResponseRecorder and dummy http.Request to
 	// execute it.
-	secureHeaders(next).ServeHTTP(rr, r)
+	app := &application{securityPolicy: &securityPolicy{GoogleFonts: true, HSTSMaxAge: 365 * 24 * time.Hour}}
+	app.secureHeaders(next).ServeHTTP(rr, r)
 
 	// Call the Result() method on the http.ResponseRecorder to get the results
 	// of the test.
@@ -39,10 +51,46 @@ func TestSecureHeaders(t *testing.T) {
 	}
 
 	// Check that the middleware has correctly set the X-XSS-Protection header
-	// on the response.
+	// on the response, turning off the XSS auditor of older browsers.
 	xssProtection := rs.Header.Get("X-XSS-Protection")
-	if xssProtection != "1; mode=block" {
-		t.Errorf("want %q; got %q", "1; mode=block", xssProtection)
+	if xssProtection != "0" {
+		t.Errorf("want %q; got %q", "0", xssProtection)
+	}
+
+	// Check the rest of the security headers.
+	for header, want := range map[string]string{
+		"Strict-Transport-Security":  "max-age=31536000; includeSubDomains",
+		"Referrer-Policy":            "strict-origin-when-cross-origin",
+		"Permissions-Policy":         "camera=(), geolocation=(), microphone=(), payment=(), usb=()",
+		"Cross-Origin-Opener-Policy": "same-origin",
+		"X-Content-Type-Options":     "nosniff",
+		"Reporting-Endpoints":        `csp="/csp-report"`,
+	} {
+		if got := rs.Header.Get(header); got != want {
+			t.Errorf("want %s %q; got %q", header, want, got)
+		}
+	}
+
+	// Check that the Content-Security-Policy is enforced, and only allows
+	// scripts with the nonce which was passed on to the next handler.
+	csp := rs.Header.Get("Content-Security-Policy")
+	if nonce == "" {
+		t.Fatal("want a CSP nonce in the request context")
+	}
+	for _, directive := range []string{
+		"script-src 'nonce-" + nonce + "' 'strict-dynamic'",
+		"style-src 'self' https://fonts.googleapis.com",
+		"font-src 'self' https://fonts.gstatic.com",
+		"img-src 'self' data:",
+		"frame-ancestors 'none'",
+		"report-uri /csp-report",
+	} {
+		if !strings.Contains(csp, directive) {
+			t.Errorf("want CSP to contain %q; got %q", directive, csp)
+		}
+	}
+	if rs.Header.Get("Content-Security-Policy-Report-Only") != "" {
+		t.Error("want no report-only CSP")
 	}
 
 	// Check that the middleware has correctly called the next handler in line
@@ -59,3 +107,225 @@ func TestSecureHeaders(t *testing.T) {
 		t.Errorf("want body to equal %q", "OK")
 	}
 }
+
+func TestSecureHeadersPolicy(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// Each response gets a new nonce.
+	app := &application{}
+	rr1, rr2 := httptest.NewRecorder(), httptest.NewRecorder()
+	app.secureHeaders(next).ServeHTTP(rr1, httptest.NewRequest("GET", "/", nil))
+	app.secureHeaders(next).ServeHTTP(rr2, httptest.NewRequest("GET", "/", nil))
+	if rr1.Header().Get("Content-Security-Policy") == rr2.Header().Get("Content-Security-Policy") {
+		t.Error("want a different CSP nonce for each response")
+	}
+
+	// Without Google Fonts, styles and fonts only come from our own origin,
+	// and without a max age no HSTS header is sent.
+	csp := rr1.Header().Get("Content-Security-Policy")
+	if strings.Contains(csp, "google") {
+		t.Errorf("want CSP not to allow Google Fonts; got %q", csp)
+	}
+	if hsts := rr1.Header().Get("Strict-Transport-Security"); hsts != "" {
+		t.Errorf("want no Strict-Transport-Security header; got %q", hsts)
+	}
+
+	// In report-only mode the policy is sent in the report-only header.
+	app = &application{securityPolicy: &securityPolicy{ReportOnly: true}}
+	rr := httptest.NewRecorder()
+	app.secureHeaders(next).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Header().Get("Content-Security-Policy") != "" {
+		t.Error("want no enforced CSP in report-only mode")
+	}
+	if !strings.Contains(rr.Header().Get("Content-Security-Policy-Report-Only"), "report-uri /csp-report") {
+		t.Errorf("want report-only CSP; got %q", rr.Header().Get("Content-Security-Policy-Report-Only"))
+	}
+}
+
+func TestRequireVerifiedUser(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       bool
+		verified     time.Time
+		wantStatus   int
+		wantLocation string
+	}{
+		{name: "Verified", policy: true, verified: time.Now(), wantStatus: http.StatusOK},
+		{name: "Unverified", policy: true, wantStatus: http.StatusSeeOther, wantLocation: "/user/verify"},
+		{name: "Policy disabled", policy: false, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{
+				requireVerifiedEmail: tt.policy,
+				session:              sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+			}
+
+			// Add an authenticated user to the request context, as the
+			// authenticate middleware would, and mock the session data.
+			r, err := http.NewRequest("GET", "/snippet/create", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user := &models.User{ID: 1, EmailVerifiedAt: tt.verified}
+			r = sessions.MockRequest(r.WithContext(context.WithValue(r.Context(), contextKeyUser, user)))
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.requireVerifiedUser(next).ServeHTTP(rr, r)
+
+			rs := rr.Result()
+			if rs.StatusCode != tt.wantStatus {
+				t.Errorf("want %d; got %d", tt.wantStatus, rs.StatusCode)
+			}
+			if loc := rs.Header.Get("Location"); loc != tt.wantLocation {
+				t.Errorf("want location %q; got %q", tt.wantLocation, loc)
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       *models.User
+		role       string
+		wantStatus int
+	}{
+		{name: "Anonymous", role: models.RoleModerator, wantStatus: http.StatusFound},
+		{name: "User", user: &models.User{ID: 1, Role: models.RoleUser}, role: models.RoleModerator, wantStatus: http.StatusForbidden},
+		{name: "Moderator", user: &models.User{ID: 1, Role: models.RoleModerator}, role: models.RoleModerator, wantStatus: http.StatusOK},
+		{name: "Admin", user: &models.User{ID: 1, Role: models.RoleAdmin}, role: models.RoleModerator, wantStatus: http.StatusOK},
+		{name: "Moderator for admin", user: &models.User{ID: 1, Role: models.RoleModerator}, role: models.RoleAdmin, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+
+			r, err := http.NewRequest("GET", "/admin", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), contextKeyUser, tt.user))
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("OK"))
+			})
+
+			rr := httptest.NewRecorder()
+			app.requireRole(tt.role)(next).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("want %d; got %d", tt.wantStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{logger: logger}
+
+	// The next handler records the user, as the authenticate middleware
+	// would, and sends a response.
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logRequestUser(r, 7)
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/snippet/1?x=y", nil)
+	r.Header.Set("X-Request-ID", "abc123")
+	setRequestID(app.logRequest(next)).ServeHTTP(rr, r)
+
+	var entry struct {
+		Level    string `json:"level"`
+		Msg      string `json:"msg"`
+		Method   string `json:"method"`
+		URI      string `json:"uri"`
+		Status   int    `json:"status"`
+		Size     int    `json:"size"`
+		Duration int64  `json:"duration"`
+		UserID   int    `json:"user_id"`
+		ID       string `json:"request_id"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+
+	if entry.Level != "INFO" || entry.Msg != "request" {
+		t.Errorf("want INFO request entry; got %s %q", entry.Level, entry.Msg)
+	}
+	if entry.Method != "GET" || entry.URI != "/snippet/1?x=y" {
+		t.Errorf("want GET /snippet/1?x=y; got %s %s", entry.Method, entry.URI)
+	}
+	if entry.Status != http.StatusTeapot {
+		t.Errorf("want status %d; got %d", http.StatusTeapot, entry.Status)
+	}
+	if entry.Size != len("short and stout") {
+		t.Errorf("want size %d; got %d", len("short and stout"), entry.Size)
+	}
+	if entry.Duration <= 0 {
+		t.Errorf("want a positive duration; got %d", entry.Duration)
+	}
+	if entry.UserID != 7 {
+		t.Errorf("want user ID 7; got %d", entry.UserID)
+	}
+	if entry.ID != "abc123" {
+		t.Errorf("want request ID %q; got %q", "abc123", entry.ID)
+	}
+}
+
+func TestSetRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		// wantID is the ID the request should be given, or empty if a new
+		// one should be generated.
+		wantID string
+	}{
+		{name: "Generated", header: ""},
+		{name: "From header", header: "lb-1234.5678", wantID: "lb-1234.5678"},
+		{name: "Invalid header", header: "bad id\r\n"},
+		{name: "Too long", header: strings.Repeat("a", 129)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = requestID(r.Context())
+			})
+
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-ID", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			setRequestID(next).ServeHTTP(rr, r)
+
+			if tt.wantID != "" && got != tt.wantID {
+				t.Errorf("want ID %q; got %q", tt.wantID, got)
+			}
+			if tt.wantID == "" && (got == "" || got == tt.header) {
+				t.Errorf("want a generated ID; got %q", got)
+			}
+			if header := rr.Header().Get("X-Request-ID"); header != got {
+				t.Errorf("want X-Request-ID header %q; got %q", got, header)
+			}
+		})
+	}
+}
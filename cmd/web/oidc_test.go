@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"snippetbox/pkg/models"
+	"snippetbox/pkg/models/mysql"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/golangcollege/sessions"
+	"golang.org/x/oauth2"
+)
+
+// The stubOIDC type is a minimal OpenID Connect provider for tests. It serves
+// a discovery document, its signing key and a token endpoint which checks the
+// PKCE verifier for each authorization code it issued.
+type stubOIDC struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	grants map[string]stubGrant
+}
+
+// The stubGrant type holds what the stub provider remembers about an
+// authorization code.
+type stubGrant struct {
+	challenge string
+	nonce     string
+}
+
+func newStubOIDC(t *testing.T) *stubOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubOIDC{key: key, grants: map[string]stubGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                s.URL,
+			"authorization_endpoint":                s.URL + "/authorize",
+			"token_endpoint":                        s.URL + "/token",
+			"jwks_uri":                              s.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.mu.Lock()
+		grant, ok := s.grants[r.PostForm.Get("code")]
+		delete(s.grants, r.PostForm.Get("code"))
+		s.mu.Unlock()
+
+		if !ok || oauth2.S256ChallengeFromVerifier(r.PostForm.Get("code_verifier")) != grant.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     s.idToken(t, grant.nonce),
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// The authorize method plays the part of a user logging in at the provider:
+// it issues an authorization code for an authorization URL, and returns the
+// code and the state to send back.
+func (s *stubOIDC) authorize(t *testing.T, authURL string) (string, string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("want S256 code challenge; got %q", q.Get("code_challenge_method"))
+	}
+
+	code, err := randomToken(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.grants[code] = stubGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	s.mu.Unlock()
+	return code, q.Get("state")
+}
+
+// The idToken method returns a signed ID token for the test user.
+func (s *stubOIDC) idToken(t *testing.T, nonce string) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            s.URL,
+		"sub":            "alice-123",
+		"aud":            "snippetbox",
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCProvider(t *testing.T) {
+	stub := newStubOIDC(t)
+	ctx := context.Background()
+
+	p, err := newOIDCProvider(ctx, "SSO", stub.URL, "snippetbox", "secret", "https://localhost/user/login/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		verifier := oauth2.GenerateVerifier()
+		code, state := stub.authorize(t, p.authCodeURL("state", "nonce", verifier))
+		if state != "state" {
+			t.Errorf("want state %q; got %q", "state", state)
+		}
+
+		claims, err := p.exchange(ctx, code, verifier, "nonce")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject != "alice-123" || claims.Email != "alice@example.com" || !claims.EmailVerified || claims.Name != "Alice" {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+	})
+
+	t.Run("Wrong verifier", func(t *testing.T) {
+		code, _ := stub.authorize(t, p.authCodeURL("state", "nonce", oauth2.GenerateVerifier()))
+		_, err := p.exchange(ctx, code, oauth2.GenerateVerifier(), "nonce")
+		if err == nil {
+			t.Error("want error for the wrong PKCE verifier")
+		}
+	})
+
+	t.Run("Wrong nonce", func(t *testing.T) {
+		verifier := oauth2.GenerateVerifier()
+		code, _ := stub.authorize(t, p.authCodeURL("state", "nonce", verifier))
+		_, err := p.exchange(ctx, code, verifier, "other")
+		if err == nil {
+			t.Error("want error for the wrong nonce")
+		}
+	})
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	stub := newStubOIDC(t)
+	p, err := newOIDCProvider(context.Background(), "SSO", stub.URL, "snippetbox", "secret", "https://localhost/user/login/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{
+		oidc:    p,
+		session: sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+	}
+
+	// A callback which doesn't match the state in the session is rejected
+	// before the code is exchanged.
+	r := sessions.MockRequest(httptest.NewRequest("GET", "/user/login/oidc/callback?code=x&state=forged", nil))
+	app.session.Put(r, "oidcState", "expected")
+
+	rr := httptest.NewRecorder()
+	app.oidcCallback(rr, r)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("want %d; got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+// The oidcCallbackRequest function returns a request to the callback for a
+// user who has just logged in at the stub provider, with the state, nonce
+// and PKCE verifier of their login in the session. If user isn't nil, the
+// request is from that logged in user.
+func oidcCallbackRequest(t *testing.T, app *application, stub *stubOIDC, user *models.User) *http.Request {
+	verifier := oauth2.GenerateVerifier()
+	code, state := stub.authorize(t, app.oidc.authCodeURL("state", "nonce", verifier))
+
+	r := httptest.NewRequest("GET", "/user/login/oidc/callback?code="+url.QueryEscape(code)+"&state="+state, nil)
+	if user != nil {
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyUser, user))
+	}
+	r = sessions.MockRequest(r)
+	app.session.Put(r, "oidcState", "state")
+	app.session.Put(r, "oidcNonce", "nonce")
+	app.session.Put(r, "oidcVerifier", verifier)
+	return r
+}
+
+func TestOIDCCallback(t *testing.T) {
+	stub := newStubOIDC(t)
+	p, err := newOIDCProvider(context.Background(), "SSO", stub.URL, "snippetbox", "secret", "https://localhost/user/login/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stub provider's ID tokens are for alice-123, whose verified email
+	// address is alice@example.com.
+	alice := &models.User{ID: 3, Name: "Alice", Email: "alice@example.com", EmailVerifiedAt: time.Now(), Role: models.RoleUser}
+	unverified := &models.User{ID: 3, Name: "Alice", Email: "alice@example.com", HasPassword: true, Role: models.RoleUser}
+	newUser := &models.User{ID: 7, Name: "Alice", Email: "alice@example.com", EmailVerifiedAt: time.Now(), Role: models.RoleUser}
+	current := &models.User{ID: 5, Name: "Carol", Email: "carol@example.com", HasPassword: true, Role: models.RoleUser}
+
+	byEmail := func(u *models.User) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "name", "email", "created"}).AddRow(u.ID, u.Name, u.Email, time.Now())
+	}
+
+	tests := []struct {
+		name         string
+		user         *models.User
+		expect       func(mock sqlmock.Sqlmock)
+		wantLocation string
+		wantUserID   int
+		wantFlash    string
+	}{
+		{
+			name: "New user",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id FROM user_identities").WithArgs(stub.URL, "alice-123").WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE email = ?").WithArgs("alice@example.com").WillReturnError(sql.ErrNoRows)
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO users").WithArgs("Alice", "alice@example.com", true).WillReturnResult(sqlmock.NewResult(7, 1))
+				mock.ExpectExec("INSERT INTO user_identities").WithArgs(stub.URL, "alice-123", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").WithArgs(7).WillReturnRows(mockUserRows(newUser))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").WithArgs(7).WillReturnRows(mockUserRows(newUser))
+			},
+			wantLocation: "/snippet/create",
+			wantUserID:   7,
+		},
+		{
+			name: "Verified email",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id FROM user_identities").WithArgs(stub.URL, "alice-123").WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE email = ?").WithArgs("alice@example.com").WillReturnRows(byEmail(alice))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").WithArgs(3).WillReturnRows(mockUserRows(alice))
+				mock.ExpectExec("INSERT INTO user_identities").WithArgs(stub.URL, "alice-123", 3).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").WithArgs(3).WillReturnRows(mockUserRows(alice))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").WithArgs(3).WillReturnRows(mockUserRows(alice))
+			},
+			wantLocation: "/snippet/create",
+			wantUserID:   3,
+		},
+		{
+			name: "Unverified email in use",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id FROM user_identities").WithArgs(stub.URL, "alice-123").WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE email = ?").WithArgs("alice@example.com").WillReturnRows(byEmail(unverified))
+				mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").WithArgs(3).WillReturnRows(mockUserRows(unverified))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO users").WillReturnError(&gomysql.MySQLError{Number: 1062,
+					Message: "Duplicate entry 'alice@example.com' for key 'users.users_uc_email'"})
+				mock.ExpectRollback()
+			},
+			wantLocation: "/user/login",
+			wantFlash:    "already exists",
+		},
+		{
+			name: "Linking while logged in",
+			user: current,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT user_id FROM user_identities").WithArgs(stub.URL, "alice-123").WillReturnError(sql.ErrNoRows)
+				mock.ExpectExec("INSERT INTO user_identities").WithArgs(stub.URL, "alice-123", 5).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantLocation: "/user/account",
+			wantFlash:    "has been linked",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			app := &application{
+				activeSessions: newMemorySessions(),
+				identities:     &mysql.IdentityModel{DB: db},
+				logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+				oidc:           p,
+				session:        sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+				users:          &mysql.UserModel{DB: db},
+			}
+			tt.expect(mock)
+
+			r := oidcCallbackRequest(t, app, stub, tt.user)
+			rr := httptest.NewRecorder()
+			app.oidcCallback(rr, r)
+
+			if rr.Code != http.StatusSeeOther {
+				t.Fatalf("want %d; got %d", http.StatusSeeOther, rr.Code)
+			}
+			if got := rr.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("want redirect to %q; got %q", tt.wantLocation, got)
+			}
+			if tt.user == nil {
+				if got := app.session.GetInt(r, "userID"); got != tt.wantUserID {
+					t.Errorf("want user %d logged in; got %d", tt.wantUserID, got)
+				}
+			}
+			if flash := app.session.GetString(r, "flash"); !strings.Contains(flash, tt.wantFlash) {
+				t.Errorf("want flash containing %q; got %q", tt.wantFlash, flash)
+			}
+		})
+	}
+}
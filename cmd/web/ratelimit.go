@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The attemptStore interface describes where the failed login attempts made
+// against a key (like a client IP or an account) are recorded. The in-memory
+// store is fine for a single instance, while *mysql.LoginAttemptModel shares
+// the state between instances.
+type attemptStore interface {
+	// Get returns the number of failed attempts for the key and the time of
+	// the last one.
+	Get(key string) (int, time.Time, error)
+	// Fail records a failed attempt for the key at the given time and
+	// returns the new number of failed attempts. If the last failure was
+	// longer ago than the window, the earlier ones are forgotten first. It
+	// must do both atomically, so that concurrent failures are all counted.
+	Fail(key string, at time.Time, window time.Duration) (int, error)
+	// Reset forgets about the failed attempts for the key.
+	Reset(key string) error
+}
+
+// The memoryAttempts type is an attemptStore which keeps the failed attempts
+// in memory. Keys are forgotten once their last failure is older than the
+// ttl, so that the map doesn't keep growing.
+type memoryAttempts struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	swept    time.Time
+	attempts map[string]*attempts
+}
+
+// The attempts type holds the number of failed attempts for a key, and the
+// time of the last one.
+type attempts struct {
+	failures int
+	last     time.Time
+}
+
+// Create a newMemoryAttempts function which returns an empty memoryAttempts,
+// forgetting keys once their last failure is older than the ttl.
+func newMemoryAttempts(ttl time.Duration) *memoryAttempts {
+	return &memoryAttempts{ttl: ttl, attempts: map[string]*attempts{}}
+}
+
+func (m *memoryAttempts) Get(key string) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attempts[key]
+	if !ok {
+		return 0, time.Time{}, nil
+	}
+	return a.failures, a.last, nil
+}
+
+func (m *memoryAttempts) Fail(key string, at time.Time, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Once per ttl, go through the keys and delete the expired ones.
+	if at.Sub(m.swept) > m.ttl {
+		for k, a := range m.attempts {
+			if at.Sub(a.last) > m.ttl {
+				delete(m.attempts, k)
+			}
+		}
+		m.swept = at
+	}
+
+	a, ok := m.attempts[key]
+	if !ok {
+		a = &attempts{}
+		m.attempts[key] = a
+	}
+	if at.Sub(a.last) > window {
+		a.failures = 0
+	}
+	a.failures++
+	a.last = at
+	return a.failures, nil
+}
+
+func (m *memoryAttempts) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, key)
+	return nil
+}
+
+// The loginLimiter type decides when login attempts should be refused. The
+// first few failures for a key are free, after which the key is locked out
+// for a period which doubles with each further failure, up to a maximum.
+// Failures are forgotten once the key has been quiet for the reset window.
+type loginLimiter struct {
+	store  attemptStore
+	free   int
+	base   time.Duration
+	max    time.Duration
+	window time.Duration
+	now    func() time.Time
+}
+
+// The loginWindow constant is how long the failed login attempts for a key
+// are remembered after the last one.
+const loginWindow = 24 * time.Hour
+
+// Create a newLoginLimiter function which returns a loginLimiter using the
+// given store, allowing free failures before locking a key out.
+func newLoginLimiter(store attemptStore, free int) *loginLimiter {
+	return &loginLimiter{
+		store:  store,
+		free:   free,
+		base:   time.Minute,
+		max:    time.Hour,
+		window: loginWindow,
+		now:    time.Now,
+	}
+}
+
+// The lockout method returns how long a key is locked out for after the
+// given number of failures.
+func (l *loginLimiter) lockout(failures int) time.Duration {
+	if failures < l.free {
+		return 0
+	}
+	d := l.base
+	for i := l.free; i < failures; i++ {
+		d *= 2
+		if d >= l.max {
+			return l.max
+		}
+	}
+	return d
+}
+
+// The Check method returns how much longer the key is locked out for, or zero
+// if an attempt may be made now.
+func (l *loginLimiter) Check(key string) (time.Duration, error) {
+	failures, last, err := l.store.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if failures == 0 || l.now().Sub(last) > l.window {
+		return 0, nil
+	}
+	wait := last.Add(l.lockout(failures)).Sub(l.now())
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// The Fail method records a failed attempt for the key and returns how long
+// the key is now locked out for, if at all.
+func (l *loginLimiter) Fail(key string) (time.Duration, error) {
+	// The store starts counting afresh if the earlier failures are outside
+	// the window.
+	failures, err := l.store.Fail(key, l.now(), l.window)
+	if err != nil {
+		return 0, err
+	}
+	return l.lockout(failures), nil
+}
+
+// The Reset method forgets about the failed attempts for the key, which we do
+// after a successful login.
+func (l *loginLimiter) Reset(key string) error {
+	return l.store.Reset(key)
+}
+
+// The loginKeys function returns the rate limiting keys for a login attempt:
+// one for the client's IP address and one for the account being logged in to.
+func loginKeys(r *http.Request, email string) (string, string) {
+	return "ip:" + clientIP(r), "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// The loginAllowed method reports whether a login attempt may be made, which
+// it may not if either the client's IP or the account is locked out.
+func (app *application) loginAllowed(ipKey, accountKey string) (bool, error) {
+	wait, err := app.ipLimiter.Check(ipKey)
+	if err != nil || wait > 0 {
+		return false, err
+	}
+	wait, err = app.accountLimiter.Check(accountKey)
+	if err != nil || wait > 0 {
+		return false, err
+	}
+	return true, nil
+}
+
+// The loginFailed method records a failed login attempt against both the
+// client's IP and the account, and logs any resulting lockouts.
+func (app *application) loginFailed(ctx context.Context, ipKey, accountKey string) error {
+	for _, l := range []struct {
+		limiter *loginLimiter
+		key     string
+	}{{app.ipLimiter, ipKey}, {app.accountLimiter, accountKey}} {
+		lockout, err := l.limiter.Fail(l.key)
+		if err != nil {
+			return err
+		}
+		if lockout > 0 {
+			app.logger.InfoContext(ctx, "login lockout", "key", l.key, "lockout", lockout)
+		}
+	}
+	return nil
+}
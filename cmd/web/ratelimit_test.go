@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiterLockout(t *testing.T) {
+	l := newLoginLimiter(newMemoryAttempts(loginWindow), 3)
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 2, want: 0},
+		{failures: 3, want: time.Minute},
+		{failures: 4, want: 2 * time.Minute},
+		{failures: 6, want: 8 * time.Minute},
+		{failures: 20, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := l.lockout(tt.failures); got != tt.want {
+			t.Errorf("%d failures: want %s; got %s", tt.failures, tt.want, got)
+		}
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	// Use a fake clock, so that we can move time forward.
+	now := time.Date(2020, 12, 17, 10, 0, 0, 0, time.UTC)
+	l := newLoginLimiter(newMemoryAttempts(loginWindow), 2)
+	l.now = func() time.Time { return now }
+
+	check := func(want time.Duration) {
+		t.Helper()
+		wait, err := l.Check("ip:1.2.3.4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != want {
+			t.Errorf("want wait of %s; got %s", want, wait)
+		}
+	}
+
+	// The first failure is free.
+	if lockout, _ := l.Fail("ip:1.2.3.4"); lockout != 0 {
+		t.Errorf("want no lockout; got %s", lockout)
+	}
+	check(0)
+
+	// The second failure locks the key out for a minute.
+	if lockout, _ := l.Fail("ip:1.2.3.4"); lockout != time.Minute {
+		t.Errorf("want lockout of 1m0s; got %s", lockout)
+	}
+	check(time.Minute)
+
+	// Other keys aren't affected.
+	if wait, _ := l.Check("ip:5.6.7.8"); wait != 0 {
+		t.Errorf("want other key not to be locked out; got %s", wait)
+	}
+
+	// Once the lockout has passed another attempt may be made, but a further
+	// failure doubles the lockout.
+	now = now.Add(time.Minute)
+	check(0)
+	if lockout, _ := l.Fail("ip:1.2.3.4"); lockout != 2*time.Minute {
+		t.Errorf("want lockout of 2m0s; got %s", lockout)
+	}
+
+	// Failures are forgotten after a quiet window.
+	now = now.Add(25 * time.Hour)
+	check(0)
+	if lockout, _ := l.Fail("ip:1.2.3.4"); lockout != 0 {
+		t.Errorf("want no lockout after the window; got %s", lockout)
+	}
+
+	// Resetting the key forgets about the failures.
+	l.Fail("ip:1.2.3.4")
+	l.Reset("ip:1.2.3.4")
+	check(0)
+}
+
+func TestMemoryAttemptsSweep(t *testing.T) {
+	now := time.Date(2020, 12, 17, 10, 0, 0, 0, time.UTC)
+	m := newMemoryAttempts(time.Hour)
+
+	m.Fail("ip:1.2.3.4", now, loginWindow)
+	m.Fail("ip:5.6.7.8", now.Add(30*time.Minute), loginWindow)
+
+	// The first key's last failure is more than an hour old by the time of
+	// the next failure, so it's deleted; the second one's isn't.
+	m.Fail("ip:9.9.9.9", now.Add(90*time.Minute), loginWindow)
+	if _, ok := m.attempts["ip:1.2.3.4"]; ok {
+		t.Error("want expired key to be deleted")
+	}
+	if len(m.attempts) != 2 {
+		t.Errorf("want 2 keys; got %d", len(m.attempts))
+	}
+}
+
+func TestLoginLimiterConcurrentFailures(t *testing.T) {
+	now := time.Date(2020, 12, 17, 10, 0, 0, 0, time.UTC)
+	l := newLoginLimiter(newMemoryAttempts(loginWindow), 3)
+	l.now = func() time.Time { return now }
+
+	// Leave some failures which are outside the window, so that the next
+	// failures have to start counting afresh.
+	for i := 0; i < 5; i++ {
+		l.store.Fail("ip:1.2.3.4", now.Add(-25*time.Hour), loginWindow)
+	}
+
+	// Each concurrent failure is counted, and none of them are lost to
+	// another one forgetting the earlier failures.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Fail("ip:1.2.3.4")
+		}()
+	}
+	wg.Wait()
+
+	failures, _, err := l.store.Get("ip:1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 10 {
+		t.Errorf("want 10 failures; got %d", failures)
+	}
+}
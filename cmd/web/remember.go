@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"snippetbox/pkg/models"
+)
+
+// The rememberStore interface describes where the "remember me" tokens are
+// kept. It is satisfied by *mysql.RememberTokenModel.
+type rememberStore interface {
+	Insert(selector, validatorHash string, userID int, sessionID string, ttl time.Duration) error
+	Get(selector string) (*models.RememberToken, error)
+	Rotate(selector, oldValidatorHash, validatorHash, sessionID string, ttl time.Duration) error
+	Delete(selector string) error
+	DeleteForSession(userID int, sessionID string) error
+	DeleteOthers(userID int, sessionID string) error
+	DeleteAllForUser(userID int) error
+}
+
+// Define the name of the "remember me" cookie, and how long the user is
+// remembered for since they were last seen.
+const (
+	rememberCookie   = "remember"
+	rememberLifetime = 30 * 24 * time.Hour
+)
+
+// The setRememberCookie function sends the "remember me" cookie for a token.
+// A maxAge of -1 deletes the cookie.
+func setRememberCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// The remember method issues a new "remember me" token for the logged in
+// user, linked to their current login session, and sends it in a cookie.
+// The cookie holds the token's selector and validator, separated by a colon.
+func (app *application) remember(w http.ResponseWriter, r *http.Request, userID int) error {
+	selector, err := randomToken(12)
+	if err != nil {
+		return err
+	}
+	validator, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	current := sessionID(app.session.GetString(r, "sessionToken"))
+	err = app.rememberTokens.Insert(selector, hashToken(validator), userID, current, rememberLifetime)
+	if err != nil {
+		return err
+	}
+
+	setRememberCookie(w, selector+":"+validator, int(rememberLifetime.Seconds()))
+	return nil
+}
+
+// The forget method revokes the "remember me" token sent with the request,
+// if any, and deletes the cookie.
+func (app *application) forget(w http.ResponseWriter, r *http.Request) error {
+	cookie, err := r.Cookie(rememberCookie)
+	if err != nil {
+		return nil
+	}
+	setRememberCookie(w, "", -1)
+
+	selector, _, _ := strings.Cut(cookie.Value, ":")
+	return app.rememberTokens.Delete(selector)
+}
+
+// The rememberRotationGrace constant is how long the validator a token had
+// before it was rotated is still accepted. Browsers often send several
+// requests at once (for a page and its assets, or from a few tabs), which all
+// carry the same cookie; the first one rotates the token, and the others
+// arrive with the old validator.
+const rememberRotationGrace = 30 * time.Second
+
+// The checkRememberToken method returns the unexpired token matching the value
+// of a "remember me" cookie, or models.ErrNoRecord if there isn't one. It also
+// reports whether the cookie holds the token's current validator; if it
+// doesn't, it holds the one the token had until it was rotated moments ago.
+//
+// Because tokens are rotated every time they're used, a valid selector with
+// any other validator means that the token was used by someone else after
+// this client got it: either the token was stolen and used by the thief, or
+// this is the thief presenting a token the user has used since. Either way, we
+// revoke all of the user's tokens and login sessions.
+func (app *application) checkRememberToken(ctx context.Context, value string) (*models.RememberToken, bool, error) {
+	selector, validator, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, false, models.ErrNoRecord
+	}
+
+	t, err := app.rememberTokens.Get(selector)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hash := []byte(hashToken(validator))
+	if subtle.ConstantTimeCompare(hash, []byte(t.ValidatorHash)) == 1 {
+		return t, true, nil
+	}
+	if t.PreviousValidatorHash != "" && time.Since(t.Rotated) < rememberRotationGrace &&
+		subtle.ConstantTimeCompare(hash, []byte(t.PreviousValidatorHash)) == 1 {
+		return t, false, nil
+	}
+
+	app.logger.WarnContext(ctx, "remember me token theft suspected: revoking all tokens and sessions", "user_id", t.UserID)
+	err = app.rememberTokens.DeleteAllForUser(t.UserID)
+	if err != nil {
+		return nil, false, err
+	}
+	// No session has an empty token, so none of them are kept.
+	err = app.activeSessions.DeleteOthers(t.UserID, "")
+	if err != nil {
+		return nil, false, err
+	}
+	return nil, false, models.ErrNoRecord
+}
+
+// The restoreSession method logs the user in from their "remember me" cookie,
+// if they sent one with a valid token, starting a new login session and
+// rotating the token. It returns the ID of the user, or 0 if they weren't
+// logged in.
+//
+// A request which arrives with the token just after a concurrent request
+// rotated it isn't given a login session of its own, as nothing would link to
+// it. Instead it's served under the login session the token was linked to by
+// that request, which sends the new cookies. Nothing is saved in its session,
+// so the caller can tell the two cases apart.
+func (app *application) restoreSession(w http.ResponseWriter, r *http.Request) (int, error) {
+	cookie, err := r.Cookie(rememberCookie)
+	if err != nil {
+		return 0, nil
+	}
+
+	t, current, err := app.checkRememberToken(r.Context(), cookie.Value)
+	if err == models.ErrNoRecord {
+		setRememberCookie(w, "", -1)
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if !current {
+		return app.linkedSessionUser(t)
+	}
+
+	err = app.logIn(r, t.UserID)
+	if err == models.ErrNoRecord {
+		setRememberCookie(w, "", -1)
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	// Rotate the token, linking it to the new login session. If another
+	// request beat us to it, undo the login and use the session that
+	// request linked the token to instead.
+	validator, err := randomToken(32)
+	if err != nil {
+		return 0, err
+	}
+	session := sessionID(app.session.GetString(r, "sessionToken"))
+	err = app.rememberTokens.Rotate(t.Selector, t.ValidatorHash, hashToken(validator), session, rememberLifetime)
+	if err == models.ErrNoRecord {
+		err = app.logOut(r)
+		if err != nil {
+			return 0, err
+		}
+		t, err = app.rememberTokens.Get(t.Selector)
+		if err == models.ErrNoRecord {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		return app.linkedSessionUser(t)
+	} else if err != nil {
+		return 0, err
+	}
+
+	setRememberCookie(w, t.Selector+":"+validator, int(rememberLifetime.Seconds()))
+	return t.UserID, nil
+}
+
+// The linkedSessionUser method returns the ID of the user a "remember me"
+// token belongs to if the login session it's linked to is still live, or 0 if
+// it isn't (for example because it's been signed out).
+func (app *application) linkedSessionUser(t *models.RememberToken) (int, error) {
+	sessions, err := app.activeSessions.ForUser(t.UserID)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range sessions {
+		if s.ID == t.SessionID {
+			return t.UserID, nil
+		}
+	}
+	return 0, nil
+}
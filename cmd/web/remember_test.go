@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"snippetbox/pkg/models"
+	"snippetbox/pkg/models/mysql"
+
+	"github.com/golangcollege/sessions"
+)
+
+// The mockRememberStore type is a rememberStore which keeps the tokens in
+// memory.
+type mockRememberStore struct {
+	tokens map[string]*models.RememberToken
+}
+
+func (m *mockRememberStore) Insert(selector, validatorHash string, userID int, sessionID string, ttl time.Duration) error {
+	m.tokens[selector] = &models.RememberToken{Selector: selector, ValidatorHash: validatorHash,
+		UserID: userID, SessionID: sessionID, Expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *mockRememberStore) Get(selector string) (*models.RememberToken, error) {
+	t, ok := m.tokens[selector]
+	if !ok {
+		return nil, models.ErrNoRecord
+	}
+	c := *t
+	return &c, nil
+}
+
+func (m *mockRememberStore) Rotate(selector, oldValidatorHash, validatorHash, sessionID string, ttl time.Duration) error {
+	t, ok := m.tokens[selector]
+	if !ok || t.ValidatorHash != oldValidatorHash {
+		return models.ErrNoRecord
+	}
+	t.PreviousValidatorHash, t.Rotated = t.ValidatorHash, time.Now()
+	t.ValidatorHash, t.SessionID = validatorHash, sessionID
+	return nil
+}
+
+func (m *mockRememberStore) Delete(selector string) error {
+	delete(m.tokens, selector)
+	return nil
+}
+
+func (m *mockRememberStore) DeleteForSession(userID int, sessionID string) error {
+	for s, t := range m.tokens {
+		if t.UserID == userID && t.SessionID == sessionID {
+			delete(m.tokens, s)
+		}
+	}
+	return nil
+}
+
+func (m *mockRememberStore) DeleteOthers(userID int, sessionID string) error {
+	for s, t := range m.tokens {
+		if t.UserID == userID && t.SessionID != sessionID {
+			delete(m.tokens, s)
+		}
+	}
+	return nil
+}
+
+func (m *mockRememberStore) DeleteAllForUser(userID int) error {
+	for s, t := range m.tokens {
+		if t.UserID == userID {
+			delete(m.tokens, s)
+		}
+	}
+	return nil
+}
+
+func TestRememberTokenTheft(t *testing.T) {
+	store := &mockRememberStore{tokens: map[string]*models.RememberToken{}}
+	app := &application{
+		activeSessions: newMemorySessions(),
+		logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		rememberTokens: store,
+		session:        sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+	}
+
+	// Issue a token for user 1, and give them another token and a login
+	// session on a second device.
+	r := sessions.MockRequest(httptest.NewRequest("GET", "/", nil))
+	rr := httptest.NewRecorder()
+	err := app.remember(rr, r, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := rr.Result().Cookies()[0]
+	if cookie.Name != rememberCookie || !cookie.HttpOnly || !cookie.Secure {
+		t.Fatalf("unexpected cookie %+v", cookie)
+	}
+	store.Insert("other", hashToken("validator"), 1, "session", time.Hour)
+	app.activeSessions.Create(1, "10.0.0.1", "Firefox", time.Hour)
+	store.Insert("bystander", hashToken("validator"), 2, "session", time.Hour)
+
+	token, current, err := app.checkRememberToken(context.Background(), cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.UserID != 1 || !current {
+		t.Errorf("want user 1's current token; got user %d, current %t", token.UserID, current)
+	}
+
+	// Presenting the right selector with the wrong validator revokes all of
+	// the user's tokens and login sessions, but not other users' tokens.
+	selector, _, _ := strings.Cut(cookie.Value, ":")
+	_, _, err = app.checkRememberToken(context.Background(), selector+":stale")
+	if err != models.ErrNoRecord {
+		t.Fatalf("want ErrNoRecord; got %v", err)
+	}
+	if _, err := store.Get(selector); err != models.ErrNoRecord {
+		t.Error("want token to be revoked")
+	}
+	if _, err := store.Get("other"); err != models.ErrNoRecord {
+		t.Error("want user's other token to be revoked")
+	}
+	if _, err := store.Get("bystander"); err != nil {
+		t.Error("want other user's token to be kept")
+	}
+	if sessions, _ := app.activeSessions.ForUser(1); len(sessions) != 0 {
+		t.Errorf("want login sessions to be revoked; got %d", len(sessions))
+	}
+}
+
+func TestRememberTokenConcurrentUse(t *testing.T) {
+	db, mock := newMockDB(t)
+	store := &mockRememberStore{tokens: map[string]*models.RememberToken{}}
+	app := &application{
+		activeSessions: newMemorySessions(),
+		logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		rememberTokens: store,
+		session:        sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+		users:          &mysql.UserModel{DB: db},
+	}
+	store.Insert("selector", hashToken("validator"), 1, "session", time.Hour)
+	user := &models.User{ID: 1, Name: "Alice", Email: "alice@example.com", HasPassword: true, EmailVerifiedAt: time.Now(),
+		SessionVersion: 1, TOTPEnabled: false, Role: models.RoleUser}
+	restore := func() (int, *http.Request, *httptest.ResponseRecorder) {
+		t.Helper()
+		r := sessions.MockRequest(httptest.NewRequest("GET", "/", nil))
+		r.AddCookie(&http.Cookie{Name: rememberCookie, Value: "selector:validator"})
+		rr := httptest.NewRecorder()
+		id, err := app.restoreSession(rr, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id, r, rr
+	}
+
+	// Two requests arrive with the same cookie. The first one starts a login
+	// session, rotates the token and sends the new cookie.
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").WithArgs(1).WillReturnRows(mockUserRows(user))
+	id, r, rr := restore()
+	if id != 1 || !app.session.Exists(r, "userID") {
+		t.Fatal("want first request to be logged in")
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 1 || cookies[0].Value == "selector:validator" {
+		t.Errorf("want rotated cookie; got %+v", cookies)
+	}
+
+	// The second one still has the old validator. It's served under the
+	// login session of the first one, without starting another one or
+	// touching the cookies, and nothing is revoked.
+	id, r, rr = restore()
+	if id != 1 {
+		t.Fatal("want second request to be logged in")
+	}
+	if app.session.Exists(r, "userID") {
+		t.Error("want nothing saved in the second request's session")
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("want no cookie; got %+v", cookies)
+	}
+	if _, err := store.Get("selector"); err != nil {
+		t.Error("want token to be kept")
+	}
+	if sessions, _ := app.activeSessions.ForUser(1); len(sessions) != 1 {
+		t.Errorf("want 1 login session; got %d", len(sessions))
+	}
+
+	// If that login session is signed out, the old validator isn't enough to
+	// log in any more.
+	app.activeSessions.DeleteOthers(1, "")
+	if id, _, _ = restore(); id != 0 {
+		t.Error("want old validator refused once the session is signed out")
+	}
+
+	// Once the grace period is over, the old validator is treated as a
+	// stolen token.
+	store.tokens["selector"].Rotated = time.Now().Add(-rememberRotationGrace)
+	if id, _, _ = restore(); id != 0 {
+		t.Error("want old validator to be refused after the grace period")
+	}
+	if _, err := store.Get("selector"); err != models.ErrNoRecord {
+		t.Error("want token to be revoked")
+	}
+}
+
+func TestForget(t *testing.T) {
+	store := &mockRememberStore{tokens: map[string]*models.RememberToken{}}
+	app := &application{rememberTokens: store}
+	store.Insert("selector", hashToken("validator"), 1, "session", time.Hour)
+
+	r := httptest.NewRequest("POST", "/user/logout", nil)
+	r.AddCookie(&http.Cookie{Name: rememberCookie, Value: "selector:validator"})
+	rr := httptest.NewRecorder()
+	err := app.forget(rr, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get("selector"); err != models.ErrNoRecord {
+		t.Error("want token to be revoked")
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("want cookie to be deleted; got %+v", cookies)
+	}
+}
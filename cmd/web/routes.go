@@ -4,14 +4,25 @@ import (
 	"github.com/bmizerany/pat"
 	"github.com/justinas/alice"
 	"net/http"
+
+	"snippetbox/pkg/models"
 )
 
+// The standardMiddleware method returns a middleware chain containing our
+// 'standard' middleware, which is used for every request our application
+// receives. The setRequestID middleware comes first, so that everything after
+// it can log the request's ID, then logRequest, so that the access log records
+// the 500 responses sent for panics which recoverPanic recovers from. The
+// secureHeaders middleware comes before recoverPanic, so that the error page
+// sent for a panic has the security headers too, and the nonce its scripts
+// need. Before all of them, traceRequest starts the request's server span.
+func (app *application) standardMiddleware() alice.Chain {
+	return alice.New(app.traceRequest, setRequestID, app.logRequest, app.secureHeaders, app.recoverPanic)
+}
+
 // Update the signature for the routes() method so that it returns a
 // http.Handler instead of *http.ServeMux.
 func (app *application) routes() http.Handler {
-	// Create a middleware chain containing our 'standard' middleware
-	// which will be used for every request our application receives.
-	standardMiddleware := alice.New(app.recoverPanic, app.logRequest, secureHeaders)
 
 	// Create a new middleware chain containing the middleware specific to
 	// our dynamic application routes. For now, this chain will only contain
@@ -25,7 +36,9 @@ func (app *application) routes() http.Handler {
 	// mux.HandleFunc("/", app.home)
 	// mux.HandleFunc("/snippet", app.showSnippet)
 	// mux.HandleFunc("/snippet/create", app.createSnippet)
-	mux := pat.New()
+	// Wrap pat's router so that requests are recorded with the pattern of
+	// the route they matched.
+	mux := routeMux{pat.New()}
 	// mux.Get("/", http.HandlerFunc(app.home))
 	// mux.Get("/snippet/create", http.HandlerFunc(app.createSnippetForm))
 	// mux.Post("/snippet/create", http.HandlerFunc(app.createSnippet))
@@ -35,18 +48,82 @@ func (app *application) routes() http.Handler {
 	// by the appropriate handler function.
 	mux.Get("/", dynamicMiddleware.ThenFunc(app.home))
 	// Add the requireAuthenticatedUser middleware to the chain.
-	mux.Get("/snippet/create", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.createSnippetForm))
+	mux.Get("/snippet/create", dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireVerifiedUser).ThenFunc(app.createSnippetForm))
 	// Add the requireAuthenticatedUser middleware to the chain.
-	mux.Post("/snippet/create", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.createSnippet))
+	mux.Post("/snippet/create", dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireVerifiedUser).ThenFunc(app.createSnippet))
+	mux.Get("/snippet/create/encrypted", dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireVerifiedUser).ThenFunc(app.createEncryptedSnippetForm))
 	mux.Get("/snippet/:id", dynamicMiddleware.ThenFunc(app.showSnippet))
+	mux.Post("/snippet/:id/unlock", dynamicMiddleware.ThenFunc(app.unlockSnippet))
+	mux.Post("/snippet/:id/star", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.starSnippet))
+	mux.Post("/snippet/:id/unstar", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.unstarSnippet))
+	mux.Post("/snippet/:id/comment", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.createComment))
+	mux.Get("/comment/:id/edit", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.editCommentForm))
+	mux.Post("/comment/:id/edit", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.editComment))
+	mux.Post("/comment/:id/delete", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.deleteComment))
 
 	// Add the five new routes.
-	mux.Get("/user/signup", dynamicMiddleware.ThenFunc(app.signupUserForm))
-	mux.Post("/user/signup", dynamicMiddleware.ThenFunc(app.signupUser))
+	// Local signup can be disabled when users log in with an external
+	// identity provider instead.
+	if app.localSignup {
+		mux.Get("/user/signup", dynamicMiddleware.ThenFunc(app.signupUserForm))
+		mux.Post("/user/signup", dynamicMiddleware.ThenFunc(app.signupUser))
+	}
 	mux.Get("/user/login", dynamicMiddleware.ThenFunc(app.loginUserForm))
 	mux.Post("/user/login", dynamicMiddleware.ThenFunc(app.loginUser))
+	mux.Get("/user/login/oidc", dynamicMiddleware.ThenFunc(app.oidcLogin))
+	mux.Get("/user/login/oidc/callback", dynamicMiddleware.ThenFunc(app.oidcCallback))
+	mux.Get("/user/login/2fa", dynamicMiddleware.ThenFunc(app.loginTwoFactorForm))
+	mux.Post("/user/login/2fa", dynamicMiddleware.ThenFunc(app.loginTwoFactor))
 	// Add the requireAuthenticatedUser middleware to the chain.
 	mux.Post("/user/logout", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.logoutUser))
+	mux.Get("/user/password/forgot", dynamicMiddleware.ThenFunc(app.forgotPasswordForm))
+	mux.Post("/user/password/forgot", dynamicMiddleware.ThenFunc(app.forgotPassword))
+	mux.Get("/user/password/reset", dynamicMiddleware.ThenFunc(app.resetPasswordForm))
+	mux.Post("/user/password/reset", dynamicMiddleware.ThenFunc(app.resetPassword))
+	mux.Get("/user/verify", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.verifyEmailForm))
+	mux.Get("/user/verify/confirm", dynamicMiddleware.ThenFunc(app.verifyEmail))
+	mux.Post("/user/verify/resend", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.resendVerificationEmail))
+	mux.Get("/user/account", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.account))
+	mux.Get("/user/account/password", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.changePasswordForm))
+	mux.Post("/user/account/password", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.changePassword))
+	mux.Get("/user/account/email", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.changeEmailForm))
+	mux.Post("/user/account/email", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.changeEmail))
+	// The admin area is only for moderators, apart from deleting users,
+	// which only admins can do.
+	moderatorMiddleware := dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireRole(models.RoleModerator))
+	mux.Get("/admin", moderatorMiddleware.ThenFunc(app.adminHome))
+	mux.Get("/admin/snippets", moderatorMiddleware.ThenFunc(app.adminSnippets))
+	mux.Post("/admin/snippets/:id/delete", moderatorMiddleware.ThenFunc(app.adminDeleteSnippet))
+	mux.Get("/admin/users", moderatorMiddleware.ThenFunc(app.adminUsers))
+	mux.Post("/admin/users/:id/disable", moderatorMiddleware.ThenFunc(app.adminDisableUser))
+	mux.Post("/admin/users/:id/enable", moderatorMiddleware.ThenFunc(app.adminEnableUser))
+	mux.Post("/admin/users/:id/delete", dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireRole(models.RoleAdmin)).ThenFunc(app.adminDeleteUser))
+
+	mux.Get("/user/account/delete", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.deleteAccountForm))
+	mux.Post("/user/account/delete", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.deleteAccount))
+	mux.Get("/user/account/export", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.exportAccount))
+	mux.Get("/user/account/sessions", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.activeSessionsPage))
+	mux.Post("/user/account/sessions/others/revoke", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.revokeOtherSessions))
+	mux.Post("/user/account/sessions/:id/revoke", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.revokeSession))
+	mux.Get("/user/account/2fa", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.twoFactorForm))
+	mux.Post("/user/account/2fa/enable", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.enableTwoFactor))
+	mux.Post("/user/account/2fa/disable", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.disableTwoFactor))
+	mux.Get("/user/dashboard", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.dashboard))
+	mux.Get("/user/starred", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.starredSnippets))
+
+	// The API used by the browser to store and fetch the ciphertext of
+	// encrypted snippets. Requests must include the CSRF token in the
+	// X-CSRF-Token header.
+	mux.Post("/api/snippet/encrypted", dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireVerifiedUser).ThenFunc(app.createEncryptedSnippet))
+	mux.Get("/api/snippet/:id/ciphertext", dynamicMiddleware.ThenFunc(app.showCiphertext))
+
+	// The health checks don't use sessions, so they only need the standard
+	// middleware.
+	mux.Get("/healthz", http.HandlerFunc(app.healthz))
+	mux.Get("/readyz", http.HandlerFunc(app.readyz))
+	// Nor does the collector for reports of Content-Security-Policy
+	// violations, which browsers send without a CSRF token.
+	mux.Post(cspReportPath, http.HandlerFunc(app.cspReport))
 
 	// Create a file server which serves files out of the "./ui/static" directory.
 	// Note that the path given to the http.Dir function is relative to the project
@@ -70,5 +147,5 @@ func (app *application) routes() http.Handler {
 	// return app.recoverPanic(app.logRequest(secureHeaders(mux)))
 
 	// Return the 'standard' middleware chain followed by the servemux.
-	return standardMiddleware.Then(mux)
+	return app.standardMiddleware().Then(mux)
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/golangcollege/sessions"
+)
+
+func TestSignupRoutes(t *testing.T) {
+	cache, err := newTemplateCache("../../ui/html/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		localSignup bool
+		wantStatus  int
+	}{
+		{"Enabled", true, http.StatusOK},
+		{"Disabled", false, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{
+				localSignup:   tt.localSignup,
+				logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+				session:       sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+				templateCache: cache,
+			}
+
+			rr := httptest.NewRecorder()
+			app.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/user/signup", nil))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("want %d; got %d", tt.wantStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestStandardMiddlewarePanic(t *testing.T) {
+	cache, err := newTemplateCache("../../ui/html/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{
+		logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		templateCache: cache,
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	})
+	rr := httptest.NewRecorder()
+	app.standardMiddleware().Then(next).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("want %d; got %d", http.StatusInternalServerError, rr.Code)
+	}
+
+	// The error page is sent with the security headers, and its script
+	// carries the nonce the Content-Security-Policy allows.
+	csp := rr.Header().Get("Content-Security-Policy")
+	m := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(csp)
+	if m == nil {
+		t.Fatalf("want a CSP with a nonce; got %q", csp)
+	}
+	if !strings.Contains(rr.Body.String(), `nonce="`+m[1]+`"`) {
+		t.Errorf("want the error page's script to carry the nonce %q", m[1])
+	}
+	if got := rr.Header().Get("X-Frame-Options"); got != "deny" {
+		t.Errorf("want X-Frame-Options %q; got %q", "deny", got)
+	}
+}
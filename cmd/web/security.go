@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The securityPolicy type holds the settings of the secureHeaders middleware.
+type securityPolicy struct {
+	// GoogleFonts allows the stylesheet and fonts from Google Fonts which the
+	// base layout links to. Without it, the link is left out and the browser
+	// falls back to its own fonts.
+	GoogleFonts bool
+	// HSTSMaxAge is how long browsers should only connect to us over HTTPS.
+	// If it's zero, the Strict-Transport-Security header isn't sent.
+	HSTSMaxAge time.Duration
+	// ReportOnly sends the Content-Security-Policy in report-only mode, so
+	// violations are reported to /csp-report without being blocked. It's
+	// handy for trying out changes to the policy.
+	ReportOnly bool
+}
+
+// The cspReportPath constant is the path of the endpoint which collects
+// reports of violations of the Content-Security-Policy.
+const cspReportPath = "/csp-report"
+
+// The contentSecurityPolicy method returns the Content-Security-Policy for a
+// response. Scripts only run if they carry the response's nonce, and
+// everything else must come from our own origin, apart from the QR code for
+// two-factor authentication (a data: URL) and, if they're allowed, Google
+// Fonts.
+func (p *securityPolicy) contentSecurityPolicy(nonce string) string {
+	styles, fonts := "'self'", "'self'"
+	if p.GoogleFonts {
+		styles += " https://fonts.googleapis.com"
+		fonts += " https://fonts.gstatic.com"
+	}
+
+	return strings.Join([]string{
+		"default-src 'self'",
+		fmt.Sprintf("script-src 'nonce-%s' 'strict-dynamic'", nonce),
+		"style-src " + styles,
+		"font-src " + fonts,
+		"img-src 'self' data:",
+		"connect-src 'self'",
+		"object-src 'none'",
+		"base-uri 'none'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+		"report-uri " + cspReportPath,
+		"report-to csp",
+	}, "; ")
+}
+
+// The contextKeyCSPNonce key holds the nonce of the response's
+// Content-Security-Policy, which scripts in our templates must carry.
+var contextKeyCSPNonce = contextKey("cspNonce")
+
+// The cspNonce function returns the nonce of the response's
+// Content-Security-Policy from the request's context.
+func cspNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(contextKeyCSPNonce).(string)
+	return nonce
+}
+
+// The secureHeaders middleware sets the security headers on every response,
+// following the application's securityPolicy. Each response gets a new random
+// nonce for its Content-Security-Policy, which is added to the request's
+// context for the templates to use.
+func (app *application) secureHeaders(next http.Handler) http.Handler {
+	policy := app.securityPolicy
+	if policy == nil {
+		policy = &securityPolicy{}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := randomToken(16)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		cspHeader := "Content-Security-Policy"
+		if policy.ReportOnly {
+			cspHeader = "Content-Security-Policy-Report-Only"
+		}
+		w.Header().Set(cspHeader, policy.contentSecurityPolicy(nonce))
+		w.Header().Set("Reporting-Endpoints", fmt.Sprintf("csp=%q", cspReportPath))
+
+		if policy.HSTSMaxAge > 0 {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int(policy.HSTSMaxAge.Seconds())))
+		}
+		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		w.Header().Set("Permissions-Policy", "camera=(), geolocation=(), microphone=(), payment=(), usb=()")
+		w.Header().Set("Cross-Origin-Opener-Policy", "same-origin")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		// X-Frame-Options is superseded by the frame-ancestors directive, but
+		// older browsers only understand it. The XSS auditor which
+		// X-XSS-Protection controls has been removed from browsers, and could
+		// itself be abused, so it's explicitly turned off.
+		w.Header().Set("X-Frame-Options", "deny")
+		w.Header().Set("X-XSS-Protection", "0")
+
+		ctx := context.WithValue(r.Context(), contextKeyCSPNonce, nonce)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// The maxCSPReportSize constant limits the size of the reports we accept, so
+// that the endpoint can't be used to fill up the logs.
+const maxCSPReportSize = 16 * 1024
+
+// The cspViolation type holds the parts of a CSP violation report which we
+// log. Browsers send reports in one of two formats: the older
+// "application/csp-report", with hyphenated field names inside a "csp-report"
+// object, and the Reporting API's "application/reports+json", a list of
+// reports with camel case field names in each one's "body".
+type cspViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	BlockedURI         string `json:"blocked-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+	Disposition        string `json:"disposition"`
+}
+
+// The reportingAPIViolation type holds the same fields as cspViolation, in
+// the format used by the Reporting API.
+type reportingAPIViolation struct {
+	DocumentURL        string `json:"documentURL"`
+	BlockedURL         string `json:"blockedURL"`
+	EffectiveDirective string `json:"effectiveDirective"`
+	SourceFile         string `json:"sourceFile"`
+	LineNumber         int    `json:"lineNumber"`
+	Disposition        string `json:"disposition"`
+}
+
+// The cspReport handler collects reports of violations of the
+// Content-Security-Policy sent by browsers, and logs them as warnings.
+func (app *application) cspReport(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCSPReportSize))
+	if err != nil {
+		app.clientError(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var violations []cspViolation
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/reports+json") {
+		var reports []struct {
+			Type string                `json:"type"`
+			Body reportingAPIViolation `json:"body"`
+		}
+		err = json.Unmarshal(body, &reports)
+		for _, report := range reports {
+			if report.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, cspViolation{
+				DocumentURI:        report.Body.DocumentURL,
+				BlockedURI:         report.Body.BlockedURL,
+				ViolatedDirective:  report.Body.EffectiveDirective,
+				EffectiveDirective: report.Body.EffectiveDirective,
+				SourceFile:         report.Body.SourceFile,
+				LineNumber:         report.Body.LineNumber,
+				Disposition:        report.Body.Disposition,
+			})
+		}
+	} else {
+		var report struct {
+			Violation cspViolation `json:"csp-report"`
+		}
+		err = json.Unmarshal(body, &report)
+		violations = append(violations, report.Violation)
+	}
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	for _, v := range violations {
+		app.logger.WarnContext(r.Context(), "content security policy violation",
+			"document_uri", v.DocumentURI,
+			"blocked_uri", v.BlockedURI,
+			"violated_directive", v.ViolatedDirective,
+			"effective_directive", v.EffectiveDirective,
+			"source_file", v.SourceFile,
+			"line_number", v.LineNumber,
+			"disposition", v.Disposition,
+		)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSPReport(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantCode    int
+		wantBlocked []string
+	}{
+		{
+			name:        "CSP report",
+			contentType: "application/csp-report",
+			body: `{"csp-report": {"document-uri": "https://localhost/", "blocked-uri": "inline",
+				"violated-directive": "script-src-elem", "effective-directive": "script-src-elem", "disposition": "enforce"}}`,
+			wantCode:    http.StatusNoContent,
+			wantBlocked: []string{"inline"},
+		},
+		{
+			name:        "Reporting API",
+			contentType: "application/reports+json",
+			body: `[{"type": "csp-violation", "body": {"documentURL": "https://localhost/", "blockedURL": "https://evil.example/x.js",
+				"effectiveDirective": "script-src-elem", "disposition": "report"}},
+				{"type": "deprecation", "body": {}}]`,
+			wantCode:    http.StatusNoContent,
+			wantBlocked: []string{"https://evil.example/x.js"},
+		},
+		{
+			name:        "Invalid JSON",
+			contentType: "application/csp-report",
+			body:        `{"csp-report":`,
+			wantCode:    http.StatusBadRequest,
+		},
+		{
+			name:        "Too large",
+			contentType: "application/csp-report",
+			body:        `{"csp-report": {"blocked-uri": "` + strings.Repeat("a", maxCSPReportSize) + `"}}`,
+			wantCode:    http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := newLogger(&buf, "json", "info")
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := &application{logger: logger}
+
+			r := httptest.NewRequest("POST", "/csp-report", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			app.cspReport(rr, r)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, rr.Code)
+			}
+
+			// Each violation is logged as a warning.
+			var blocked []string
+			dec := json.NewDecoder(&buf)
+			for dec.More() {
+				var entry map[string]interface{}
+				err := dec.Decode(&entry)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if entry["level"] != "WARN" || entry["msg"] != "content security policy violation" {
+					t.Errorf("unexpected log entry %v", entry)
+				}
+				blocked = append(blocked, entry["blocked_uri"].(string))
+			}
+			if strings.Join(blocked, ",") != strings.Join(tt.wantBlocked, ",") {
+				t.Errorf("want blocked %q; got %q", tt.wantBlocked, blocked)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"snippetbox/pkg/models"
+)
+
+// The sessionStore interface describes where the server-side records of login
+// sessions are kept. Each login session is identified by a random token held
+// in the (encrypted) session cookie, and the store records the device, IP
+// address and last activity of each one so that they can be listed and
+// revoked. It is satisfied by *mysql.SessionModel, while the in-memory store
+// is handy for tests and local development.
+type sessionStore interface {
+	Create(userID int, ip, userAgent string, lifetime time.Duration) (string, error)
+	Get(token string) (*models.Session, error)
+	Touch(token, ip string) error
+	ForUser(userID int) ([]*models.Session, error)
+	Delete(token string) error
+	DeleteByID(userID int, id string) error
+	DeleteOthers(userID int, token string) error
+}
+
+// Sessions are only touched if they haven't been seen for this long, so that
+// we don't write to the store on every request.
+const sessionTouchInterval = time.Minute
+
+// The memorySessions type is a sessionStore which keeps the sessions in
+// memory, keyed by the hash of their token.
+type memorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]*models.Session
+	now      func() time.Time
+}
+
+// Create a newMemorySessions function which returns an empty memorySessions.
+func newMemorySessions() *memorySessions {
+	return &memorySessions{sessions: map[string]*models.Session{}, now: time.Now}
+}
+
+// The hashToken function returns the hex-encoded SHA-256 hash of a token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// The sessionID function returns the ID of the session for a token, which is
+// the hash of the token, just like *mysql.SessionModel.
+func sessionID(token string) string {
+	return hashToken(token)
+}
+
+// The randomToken function returns a random, URL-safe token made from n
+// random bytes.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (m *memorySessions) Create(userID int, ip, userAgent string, lifetime time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now().UTC()
+	m.sessions[sessionID(token)] = &models.Session{
+		ID:        sessionID(token),
+		UserID:    userID,
+		IP:        ip,
+		UserAgent: userAgent,
+		Created:   now,
+		LastSeen:  now,
+		Expires:   now.Add(lifetime),
+	}
+	return token, nil
+}
+
+func (m *memorySessions) Get(token string) (*models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[sessionID(token)]
+	if !ok || !s.Expires.After(m.now()) {
+		return nil, models.ErrNoRecord
+	}
+	// Return a copy, so that callers can't change the stored session.
+	c := *s
+	return &c, nil
+}
+
+func (m *memorySessions) Touch(token, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[sessionID(token)]; ok {
+		s.LastSeen = m.now().UTC()
+		s.IP = ip
+	}
+	return nil
+}
+
+func (m *memorySessions) ForUser(userID int) ([]*models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := []*models.Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.Expires.After(m.now()) {
+			c := *s
+			sessions = append(sessions, &c)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+func (m *memorySessions) Delete(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, sessionID(token))
+	return nil
+}
+
+func (m *memorySessions) DeleteByID(userID int, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[id]; ok && s.UserID == userID {
+		delete(m.sessions, id)
+	}
+	return nil
+}
+
+func (m *memorySessions) DeleteOthers(userID int, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keep := sessionID(token)
+	for id, s := range m.sessions {
+		if s.UserID == userID && id != keep {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// The currentSession method returns the server-side record of the current
+// login session, or models.ErrNoRecord if there isn't one (for example because
+// it has been revoked). The record is touched if it hasn't been seen recently.
+func (app *application) currentSession(r *http.Request) (*models.Session, error) {
+	token := app.session.GetString(r, "sessionToken")
+	if token == "" {
+		return nil, models.ErrNoRecord
+	}
+	s, err := app.activeSessions.Get(token)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(s.LastSeen) > sessionTouchInterval {
+		err = app.activeSessions.Touch(token, clientIP(r))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
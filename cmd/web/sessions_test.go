@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"snippetbox/pkg/models"
+)
+
+func TestMemorySessions(t *testing.T) {
+	store := newMemorySessions()
+
+	a, err := store.Create(1, "10.0.0.1", "Firefox", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := store.Create(1, "10.0.0.2", "Chrome", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := store.Create(2, "10.0.0.3", "Safari", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Get(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != sessionID(a) || s.UserID != 1 || s.UserAgent != "Firefox" {
+		t.Errorf("unexpected session %+v", s)
+	}
+
+	sessions, _ := store.ForUser(1)
+	if len(sessions) != 2 {
+		t.Fatalf("want 2 sessions for user 1; got %d", len(sessions))
+	}
+
+	// A user can't revoke another user's session by its ID.
+	store.DeleteByID(1, sessionID(c))
+	if _, err := store.Get(c); err != nil {
+		t.Errorf("want other user's session to be kept; got %v", err)
+	}
+
+	// Signing out other sessions keeps the current one, and doesn't affect
+	// other users.
+	store.DeleteOthers(1, a)
+	if _, err := store.Get(a); err != nil {
+		t.Errorf("want current session to be kept; got %v", err)
+	}
+	if _, err := store.Get(b); err != models.ErrNoRecord {
+		t.Errorf("want other session to be revoked; got %v", err)
+	}
+	if _, err := store.Get(c); err != nil {
+		t.Errorf("want other user's session to be kept; got %v", err)
+	}
+
+	store.Delete(a)
+	if _, err := store.Get(a); err != models.ErrNoRecord {
+		t.Errorf("want deleted session to be revoked; got %v", err)
+	}
+}
+
+func TestMemorySessionsExpiry(t *testing.T) {
+	store := newMemorySessions()
+	token, err := store.Create(1, "10.0.0.1", "Firefox", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := store.Get(token); err != models.ErrNoRecord {
+		t.Errorf("want expired session to be rejected; got %v", err)
+	}
+	if sessions, _ := store.ForUser(1); len(sessions) != 0 {
+		t.Errorf("want no sessions listed; got %d", len(sessions))
+	}
+}
@@ -15,12 +15,29 @@ import (
 // to it as the build progresses.
 type templateData struct {
 	AuthenticateUser *models.User
+	Chart            []*chartBar
+	Comment          *models.Comment
+	Comments         []*models.Comment
+	CSPNonce         string
 	CSRFToken        string
+	CurrentSession   string
 	CurrentYear      int
 	Flash            string
 	Form             *forms.Form
+	GoogleFonts      bool
+	IdentityLinked   bool
+	LocalSignup      bool
+	OIDCName         string
+	Popular          []*models.Snippet
+	QRCode           template.URL
+	RecoveryCodes    []string
+	RequestID        string
+	Sessions         []*models.Session
 	Snippet          *models.Snippet
 	Snippets         []*models.Snippet
+	Starred          bool
+	TOTPSecret       string
+	Users            []*models.User
 }
 
 // Create a humanDate function which returns a nicely formatted string
@@ -34,11 +51,70 @@ func humanDate(t time.Time) string {
 	return t.UTC().Format("02 Jan 2006 at 15:04")
 }
 
+// The commentData type holds what the "comment" template needs to render a
+// single comment: the comment itself, whether the current user wrote it, and
+// the CSRF token for the delete form.
+type commentData struct {
+	Comment   *models.Comment
+	Author    bool
+	CSRFToken string
+}
+
+// Create a newCommentData function which bundles a comment with the
+// surrounding page data, so it can be passed to the "comment" template.
+func newCommentData(c *models.Comment, td *templateData) *commentData {
+	return &commentData{
+		Comment:   c,
+		Author:    td.AuthenticateUser != nil && td.AuthenticateUser.ID == c.UserID,
+		CSRFToken: td.CSRFToken,
+	}
+}
+
+// The chartDays constant sets how many days are shown on the dashboard's
+// daily views chart.
+const chartDays = 30
+
+// The chartBar type holds a single bar of the daily views chart. Height is
+// the height of the bar as a percentage of the tallest one.
+type chartBar struct {
+	Day    time.Time
+	Views  int
+	Height int
+}
+
+// Create a newChart function which turns the daily views into bars for the
+// given number of days up to and including the end day. Days without any
+// views get an empty bar.
+func newChart(daily []*models.DailyViews, end time.Time, days int) []*chartBar {
+	views := map[string]int{}
+	max := 0
+	for _, d := range daily {
+		views[d.Day.Format("2006-01-02")] = d.Views
+		if d.Views > max {
+			max = d.Views
+		}
+	}
+
+	bars := make([]*chartBar, days)
+	for i := range bars {
+		day := end.AddDate(0, 0, i-days+1)
+		bar := &chartBar{Day: day, Views: views[day.Format("2006-01-02")]}
+		if max > 0 {
+			bar.Height = bar.Views * 100 / max
+		}
+		bars[i] = bar
+	}
+	return bars
+}
+
 // Initialize a template.FuncMap object and store it in a global variable. This
 // essentially a string-keyed map which acts as a lookup between the names of the
 // custom template functions and the functions themselves.
 var functions = template.FuncMap{
-	"humanDate": humanDate,
+	"commentData": newCommentData,
+	"humanDate":   humanDate,
+	"mul":         func(a, b int) int { return a * b },
+	"sub":         func(a, b int) int { return a - b },
 }
 
 func newTemplateCache(dir string) (map[string]*template.Template, error) {
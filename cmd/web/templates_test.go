@@ -1,8 +1,11 @@
 package main
 
 import (
+	"path/filepath"
 	"testing"
 	"time"
+
+	"snippetbox/pkg/models"
 )
 
 func TestHumanDate(t *testing.T) {
@@ -45,3 +48,71 @@ func TestHumanDate(t *testing.T) {
 		})
 	}
 }
+
+func TestNewTemplateCache(t *testing.T) {
+	// Parse the real templates on disk so that a typo in any page, layout or
+	// partial is caught before the application is started.
+	cache, err := newTemplateCache("../../ui/html/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := filepath.Glob("../../ui/html/*.page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range pages {
+		if _, ok := cache[filepath.Base(page)]; !ok {
+			t.Errorf("want template %q in cache", filepath.Base(page))
+		}
+	}
+}
+
+func TestNewCommentData(t *testing.T) {
+	comment := &models.Comment{ID: 1, UserID: 7}
+
+	tests := []struct {
+		name string
+		user *models.User
+		want bool
+	}{
+		{name: "Anonymous", user: nil, want: false},
+		{name: "Author", user: &models.User{ID: 7}, want: true},
+		{name: "Other user", user: &models.User{ID: 8}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cd := newCommentData(comment, &templateData{AuthenticateUser: tt.user, CSRFToken: "token"})
+			if cd.Author != tt.want {
+				t.Errorf("want %t; got %t", tt.want, cd.Author)
+			}
+			if cd.CSRFToken != "token" {
+				t.Errorf("want %q; got %q", "token", cd.CSRFToken)
+			}
+		})
+	}
+}
+
+func TestNewChart(t *testing.T) {
+	end := time.Date(2020, 12, 17, 0, 0, 0, 0, time.UTC)
+	daily := []*models.DailyViews{
+		{Day: end.AddDate(0, 0, -2), Views: 5},
+		{Day: end, Views: 10},
+	}
+
+	bars := newChart(daily, end, 3)
+	if len(bars) != 3 {
+		t.Fatalf("want 3 bars; got %d", len(bars))
+	}
+
+	want := []struct{ views, height int }{{5, 50}, {0, 0}, {10, 100}}
+	for i, w := range want {
+		if bars[i].Views != w.views || bars[i].Height != w.height {
+			t.Errorf("bar %d: want %d views at height %d; got %d views at height %d", i, w.views, w.height, bars[i].Views, bars[i].Height)
+		}
+	}
+	if !bars[2].Day.Equal(end) {
+		t.Errorf("want last bar on %v; got %v", end, bars[2].Day)
+	}
+}
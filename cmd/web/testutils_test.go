@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"snippetbox/pkg/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// The newMockDB function returns a sql.DB backed by go-sqlmock, so that the
+// models can be used in handler tests without a MySQL server. When the test
+// ends, it checks that all the queries it expected were made.
+func newMockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return db, mock
+}
+
+// The mockUserRows function returns the rows which UserModel.Get reads for a
+// user.
+func mockUserRows(u *models.User) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "name", "email", "created", "has_password", "email_verified_at", "session_version", "totp_enabled", "role", "disabled"}).
+		AddRow(u.ID, u.Name, u.Email, time.Now(), u.HasPassword, u.EmailVerifiedAt, u.SessionVersion, u.TOTPEnabled, u.Role, u.Disabled)
+}
+
+// The postForm function returns a new POST request for the path with the
+// form values as its body. Any cookies given are added to it, so that it can
+// carry on the session of an earlier response.
+func postForm(path string, form url.Values, cookies ...*http.Cookie) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// The mockMailer type is a mailer which passes the address of each email sent
+// through it to a channel, so that tests can wait for emails sent in the
+// background.
+type mockMailer struct {
+	sent chan string
+}
+
+func (m *mockMailer) Send(to, subject, body string) error {
+	m.sent <- to
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The throttle type keeps count of the failed attempts made against a key
+// (for example a snippet ID and client IP) and blocks further attempts once
+// too many have failed within a window. Keys are forgotten once their window
+// has passed, so that the map doesn't keep growing.
+type throttle struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	swept    time.Time
+	failures map[string]*failures
+}
+
+// The failures type records how many attempts have failed for a key, and when
+// the first of them happened.
+type failures struct {
+	count int
+	since time.Time
+}
+
+// Create a newThrottle function which returns a throttle allowing at most max
+// failed attempts per key within the given window.
+func newThrottle(max int, window time.Duration) *throttle {
+	return &throttle{
+		max:      max,
+		window:   window,
+		failures: map[string]*failures{},
+	}
+}
+
+// The Allow method reports whether another attempt may be made for the key.
+func (t *throttle) Allow(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+	if !ok {
+		return true
+	}
+	// Once the window has passed, forget about the earlier failures.
+	if time.Since(f.since) > t.window {
+		delete(t.failures, key)
+		return true
+	}
+	return f.count < t.max
+}
+
+// The Fail method records a failed attempt for the key.
+func (t *throttle) Fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Once per window, go through the keys and delete the expired ones.
+	if time.Since(t.swept) > t.window {
+		for k, f := range t.failures {
+			if time.Since(f.since) > t.window {
+				delete(t.failures, k)
+			}
+		}
+		t.swept = time.Now()
+	}
+
+	f, ok := t.failures[key]
+	if !ok || time.Since(f.since) > t.window {
+		f = &failures{since: time.Now()}
+		t.failures[key] = f
+	}
+	f.count++
+}
+
+// The Reset method forgets about any failed attempts for the key, which we
+// do after a successful attempt.
+func (t *throttle) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.failures, key)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(3, time.Minute)
+
+	// The first three failures are allowed, but not a fourth attempt.
+	for i := 0; i < 3; i++ {
+		if !th.Allow("a") {
+			t.Fatalf("attempt %d: want allowed", i+1)
+		}
+		th.Fail("a")
+	}
+	if th.Allow("a") {
+		t.Error("want attempt to be throttled")
+	}
+
+	// Other keys aren't affected.
+	if !th.Allow("b") {
+		t.Error("want other key to be allowed")
+	}
+
+	// Resetting the key allows attempts again.
+	th.Reset("a")
+	if !th.Allow("a") {
+		t.Error("want attempt to be allowed after reset")
+	}
+}
+
+func TestThrottleWindow(t *testing.T) {
+	th := newThrottle(1, time.Minute)
+	th.Fail("a")
+	if th.Allow("a") {
+		t.Fatal("want attempt to be throttled")
+	}
+
+	// Pretend the failure happened before the window started.
+	th.failures["a"].since = time.Now().Add(-2 * time.Minute)
+	if !th.Allow("a") {
+		t.Error("want attempt to be allowed once the window has passed")
+	}
+}
+
+func TestThrottleSweep(t *testing.T) {
+	th := newThrottle(1, time.Minute)
+	th.Fail("a")
+	th.Fail("b")
+
+	// Pretend the first failure and the last sweep happened before the
+	// window started. The next failure deletes the expired key.
+	th.failures["a"].since = time.Now().Add(-2 * time.Minute)
+	th.swept = time.Now().Add(-2 * time.Minute)
+	th.Fail("c")
+	if _, ok := th.failures["a"]; ok {
+		t.Error("want expired key to be deleted")
+	}
+	if len(th.failures) != 2 {
+		t.Errorf("want 2 keys; got %d", len(th.failures))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The tracerName constant is the name of the instrumentation scope for the
+// spans we start ourselves.
+const tracerName = "snippetbox"
+
+// The propagator reads and writes the W3C Trace Context (and Baggage)
+// headers, so that our spans join traces started by the caller.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// The newTracerProvider function creates a tracer provider which exports
+// spans with the given exporter: "stdout" writes them to out, which is handy
+// during development, and "otlp" sends them over OTLP/HTTP to the endpoint
+// (or to the one in the OTEL_EXPORTER_OTLP_ENDPOINT environment variable if
+// it's empty). For "none" it returns nil, and no spans are recorded.
+func newTracerProvider(ctx context.Context, exporter, endpoint string, out io.Writer) (*sdktrace.TracerProvider, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "none":
+		return nil, nil
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(out))
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("snippetbox"))),
+	), nil
+}
+
+// The traceRequest middleware starts a server span for each request, as a
+// child of the caller's span if the request carries a traceparent header.
+// The span is named after the method until withRoute renames it after the
+// pattern of the route the request matched.
+func (app *application) traceRequest(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "",
+		otelhttp.WithTracerProvider(app.tracerProvider),
+		otelhttp.WithPropagators(propagator),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}),
+	)
+}
+
+// The traceRoute function names the request's server span after the route
+// pattern it matched (like "GET /snippet/:id"), so that spans for the same
+// route are grouped together.
+func traceRoute(r *http.Request, pattern string) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(r.Method + " " + pattern)
+	span.SetAttributes(semconv.HTTPRoute(pattern))
+}
+
+// The startSpan function starts a child span of the one in the context. The
+// tracer comes from the parent span, so if the request isn't being traced
+// the child isn't either.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, opts...)
+}
+
+// The sqlTraceOptions function returns the options for the otelsql wrapper
+// around the MySQL driver, which records a span for each query. Spans are
+// only recorded for queries made with the context of a traced request, so
+// that background work (like flushing view counts) doesn't start traces of
+// its own.
+func sqlTraceOptions() []otelsql.Option {
+	return []otelsql.Option{
+		otelsql.WithAttributes(semconv.DBSystemMySQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid()
+			},
+		}),
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"snippetbox/pkg/models/mysql"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/XSAM/otelsql"
+	"github.com/golangcollege/sessions"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceRequest(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	cache, err := newTemplateCache("../../ui/html/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{
+		session:        sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+		templateCache:  cache,
+		tracerProvider: tp,
+	}
+
+	// Route a request through traceRequest to a handler which renders a
+	// page, like the real routes do.
+	handler := app.traceRequest(withRoute("/snippet/:id", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.render(w, r, "home.page.html", nil)
+	})))
+
+	// The request carries the W3C trace context of the caller's span.
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+	r := sessions.MockRequest(httptest.NewRequest("GET", "/snippet/1", nil))
+	r.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rr.Code)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("want 2 spans; got %d", len(spans))
+	}
+	render, server := spans[0], spans[1]
+
+	// The server span is named after the route pattern and continues the
+	// caller's trace.
+	if server.Name != "GET /snippet/:id" {
+		t.Errorf("want server span %q; got %q", "GET /snippet/:id", server.Name)
+	}
+	if server.SpanKind != trace.SpanKindServer {
+		t.Errorf("want server span kind; got %v", server.SpanKind)
+	}
+	if server.SpanContext.TraceID().String() != traceID {
+		t.Errorf("want trace ID %s; got %s", traceID, server.SpanContext.TraceID())
+	}
+	if server.Parent.SpanID().String() != parentID {
+		t.Errorf("want parent span ID %s; got %s", parentID, server.Parent.SpanID())
+	}
+
+	// The template execution is recorded as a child of the server span.
+	if render.Name != "render home.page.html" {
+		t.Errorf("want render span %q; got %q", "render home.page.html", render.Name)
+	}
+	if render.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("want render span to be a child of the server span")
+	}
+}
+
+func TestStartSpanUntraced(t *testing.T) {
+	// Without a span in the context, startSpan starts one which isn't
+	// recorded.
+	_, span := startSpan(context.Background(), "untraced")
+	defer span.End()
+	if span.IsRecording() || span.SpanContext().IsValid() {
+		t.Error("want a span which isn't recorded")
+	}
+}
+
+func TestSQLTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	// Wrap a sqlmock connection with the same options as the MySQL driver,
+	// but using our tracer provider rather than the global one.
+	_, mock, err := sqlmock.NewWithDSN("sql_tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := otelsql.Open("sqlmock", "sql_tracing", append(sqlTraceOptions(), otelsql.WithTracerProvider(tp))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	snippets := &mysql.SnippetModel{DB: db}
+
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("SELECT (.+) FROM snippets").WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"id", "title", "content", "created", "expires", "user_id", "private", "hashed_password", "encrypted"}).
+				AddRow(1, "Title", "Content", time.Now(), time.Now().Add(time.Hour), 0, false, nil, false),
+		)
+	}
+
+	// A query made with the context of a traced request is recorded as a
+	// child of the request's span.
+	ctx, span := tp.Tracer("test").Start(context.Background(), "GET /snippet/:id")
+	_, err = snippets.GetContext(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	// One made without isn't recorded at all.
+	_, err = snippets.GetContext(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var queries []sdktrace.ReadOnlySpan
+	for _, s := range exporter.GetSpans().Snapshots() {
+		if s.Name() == "GET /snippet/:id" {
+			continue
+		}
+		if s.Parent().SpanID() != span.SpanContext().SpanID() {
+			t.Errorf("want span %q to be a child of the request's span", s.Name())
+		}
+		if s.Name() == "sql.conn.query" {
+			queries = append(queries, s)
+		}
+	}
+	if len(queries) != 1 {
+		t.Fatalf("want 1 query span; got %d", len(queries))
+	}
+	var system string
+	for _, attr := range queries[0].Attributes() {
+		if attr.Key == semconv.DBSystemKey {
+			system = attr.Value.AsString()
+		}
+	}
+	if system != "mysql" {
+		t.Errorf("want db.system %q; got %q", "mysql", system)
+	}
+}
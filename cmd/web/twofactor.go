@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"snippetbox/pkg/forms"
+	"snippetbox/pkg/totp"
+)
+
+// The generateRecoveryCodes function returns n random recovery codes, each
+// made of two groups of five characters, like "abcde-fghij".
+func generateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 10)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// The verifySecondFactor method checks a two-factor code entered by a user,
+// which may either be a code from their authenticator app or one of their
+// recovery codes. Each code only works once, and repeated failures lock the
+// user's second factor out in the same way as failed logins.
+func (app *application) verifySecondFactor(ctx context.Context, id int, code string) (bool, error) {
+	key := fmt.Sprintf("2fa:%d", id)
+	wait, err := app.accountLimiter.Check(key)
+	if err != nil || wait > 0 {
+		return false, err
+	}
+
+	secret, err := app.users.TOTPContext(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	var ok bool
+	if counter, valid := totp.Validate(secret, code, time.Now()); valid {
+		ok, err = app.users.UseTOTPCounterContext(ctx, id, counter)
+	} else {
+		ok, err = app.users.UseRecoveryCodeContext(ctx, id, code)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !ok {
+		lockout, err := app.accountLimiter.Fail(key)
+		if err != nil {
+			return false, err
+		}
+		if lockout > 0 {
+			app.logger.InfoContext(ctx, "login lockout", "key", key, "lockout", lockout)
+		}
+		return false, nil
+	}
+	return true, app.accountLimiter.Reset(key)
+}
+
+// The twoFactorEnrollData method returns the template data for the page where
+// a user sets up two-factor authentication: the secret, both as text and as a
+// QR code to scan with an authenticator app, and the form to confirm it.
+func (app *application) twoFactorEnrollData(r *http.Request, secret string, form *forms.Form) (*templateData, error) {
+	uri := totp.URI("Snippetbox", app.authenticatedUser(r).Email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	return &templateData{
+		Form:       form,
+		QRCode:     template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+		TOTPSecret: secret,
+	}, nil
+}
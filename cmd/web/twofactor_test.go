@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"snippetbox/pkg/models"
+	"snippetbox/pkg/models/mysql"
+	"snippetbox/pkg/passwords"
+	"snippetbox/pkg/totp"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golangcollege/sessions"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("want 10 codes; got %d", len(codes))
+	}
+
+	rx := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if !rx.MatchString(code) {
+			t.Errorf("want code like %q; got %q", "abcde-fghij", code)
+		}
+		if seen[code] {
+			t.Errorf("want unique codes; got %q twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	db, mock := newMockDB(t)
+	app := &application{
+		session:        sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+		users:          &mysql.UserModel{DB: db, Passwords: &passwords.Hasher{Algorithm: passwords.Bcrypt, BcryptCost: bcrypt.MinCost}},
+		ipLimiter:      newLoginLimiter(newMemoryAttempts(loginWindow), 5),
+		accountLimiter: newLoginLimiter(newMemoryAttempts(loginWindow), 5),
+		activeSessions: newMemorySessions(),
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("pa55word"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: 1, Name: "Alice", Email: "alice@example.com", HasPassword: true, EmailVerifiedAt: time.Now(),
+		SessionVersion: 1, TOTPEnabled: true, Role: models.RoleUser}
+
+	// The password is checked first, and as the user has two-factor
+	// authentication enabled they're asked for a code.
+	mock.ExpectQuery("SELECT id, hashed_password, disabled FROM users").WithArgs("alice@example.com").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "hashed_password", "disabled"}).AddRow(1, string(hashedPassword), false),
+	)
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").WithArgs(1).WillReturnRows(mockUserRows(user))
+
+	rr := httptest.NewRecorder()
+	app.session.Enable(http.HandlerFunc(app.loginUser)).ServeHTTP(rr,
+		postForm("/user/login", url.Values{"email": {"alice@example.com"}, "password": {"pa55word"}}))
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("want %d; got %d", http.StatusSeeOther, rr.Code)
+	}
+	if got := rr.Header().Get("Location"); got != "/user/login/2fa" {
+		t.Fatalf("want redirect to %q; got %q", "/user/login/2fa", got)
+	}
+	cookies := rr.Result().Cookies()
+
+	// Then the code is checked, with the session saved by the first step,
+	// and the user is logged in.
+	code, err := totp.Code(secret, totp.Counter(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("SELECT totp_secret FROM users").WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"totp_secret"}).AddRow(secret),
+	)
+	mock.ExpectExec("UPDATE users SET totp_last_counter").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id = ?").WithArgs(1).WillReturnRows(mockUserRows(user))
+
+	rr = httptest.NewRecorder()
+	app.session.Enable(http.HandlerFunc(app.loginTwoFactor)).ServeHTTP(rr,
+		postForm("/user/login/2fa", url.Values{"code": {code}}, cookies...))
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("want %d; got %d", http.StatusSeeOther, rr.Code)
+	}
+	if got := rr.Header().Get("Location"); got != "/snippet/create" {
+		t.Fatalf("want redirect to %q; got %q", "/snippet/create", got)
+	}
+
+	var userID int
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rr.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	app.session.Enable(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID = app.session.GetInt(r, "userID")
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if userID != 1 {
+		t.Errorf("want user 1 logged in; got %d", userID)
+	}
+}
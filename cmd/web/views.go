@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"snippetbox/pkg/models"
+)
+
+// The viewStore interface describes where batches of view counts are
+// written to. It is satisfied by *mysql.ViewModel.
+type viewStore interface {
+	Add(day time.Time, counts map[int]int) error
+}
+
+// The viewCounter type counts snippet views in memory and periodically
+// flushes them to the store in a single batch, so that viewing a snippet
+// doesn't need a database write. Each viewer is only counted once per
+// snippet per day. The pending counts are kept by day, so that those from
+// before midnight are still written for the right day.
+type viewCounter struct {
+	mu      sync.Mutex
+	store   viewStore
+	day     time.Time
+	seen    map[string]bool
+	pending map[time.Time]map[int]int
+	now     func() time.Time
+}
+
+// Create a newViewCounter function which returns a viewCounter writing to the
+// given store.
+func newViewCounter(store viewStore) *viewCounter {
+	return &viewCounter{
+		store:   store,
+		day:     today(),
+		seen:    map[string]bool{},
+		pending: map[time.Time]map[int]int{},
+		now:     time.Now,
+	}
+}
+
+// The today function returns the start of the current day in UTC.
+func today() time.Time {
+	return startOfDay(time.Now())
+}
+
+// The startOfDay function returns the start of the day t falls on in UTC.
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// The Record method counts a view of a snippet by a viewer, unless the viewer
+// has already been counted for that snippet today.
+func (vc *viewCounter) Record(snippetID int, viewer string) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	// When the day changes, start de-duplicating afresh. Any counts still
+	// pending for the previous day are left to be flushed.
+	if d := startOfDay(vc.now()); !d.Equal(vc.day) {
+		vc.day = d
+		vc.seen = map[string]bool{}
+	}
+
+	key := fmt.Sprintf("%d|%s", snippetID, viewer)
+	if vc.seen[key] {
+		return
+	}
+	vc.seen[key] = true
+	vc.add(vc.day, map[int]int{snippetID: 1})
+}
+
+// The add method adds counts to the pending ones for a day. The caller must
+// hold the mutex.
+func (vc *viewCounter) add(day time.Time, counts map[int]int) {
+	pending, ok := vc.pending[day]
+	if !ok {
+		pending = map[int]int{}
+		vc.pending[day] = pending
+	}
+	for id, n := range counts {
+		pending[id] += n
+	}
+}
+
+// The Flush method writes the pending view counts to the store, a batch for
+// each day. The counts are taken out of the counter first, so that views can
+// still be recorded during the write. If a write fails, the counts which
+// weren't written are put back to be retried next time.
+func (vc *viewCounter) Flush() error {
+	vc.mu.Lock()
+	pending := vc.pending
+	vc.pending = map[time.Time]map[int]int{}
+	vc.mu.Unlock()
+
+	for day, counts := range pending {
+		err := vc.store.Add(day, counts)
+		if err != nil {
+			vc.mu.Lock()
+			defer vc.mu.Unlock()
+			for day, counts := range pending {
+				vc.add(day, counts)
+			}
+			return err
+		}
+		delete(pending, day)
+	}
+	return nil
+}
+
+// The runViewFlusher method flushes the pending view counts at every interval,
+// logging any errors, until the done channel is closed. It flushes them one
+// last time before it returns, so that no views are lost on shutdown.
+func (app *application) runViewFlusher(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := app.views.Flush(); err != nil {
+				app.logger.Error("flushing views", "error", err)
+			}
+		case <-done:
+			if err := app.views.Flush(); err != nil {
+				app.logger.Error("flushing views", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// The recordView method counts a view of a snippet by the current user,
+// unless they are the snippet's owner.
+func (app *application) recordView(r *http.Request, s *models.Snippet) {
+	if user := app.authenticatedUser(r); user != nil && user.ID == s.UserID {
+		return
+	}
+	app.views.Record(s.ID, app.viewerKey(r))
+}
+
+// The viewerKey function identifies the viewer of a request for the purpose of
+// de-duplicating views. Logged in users are identified by their ID, and anyone
+// else by a hash of their IP address, so raw addresses aren't kept in memory.
+func (app *application) viewerKey(r *http.Request) string {
+	if user := app.authenticatedUser(r); user != nil {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+	sum := sha256.Sum256([]byte(clientIP(r)))
+	return "ip:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// The mockViewStore type records the batches of view counts written to it,
+// and the days they were for, and fails the writes while err is set.
+type mockViewStore struct {
+	counts map[int]int
+	days   []time.Time
+	err    error
+}
+
+func (m *mockViewStore) Add(day time.Time, counts map[int]int) error {
+	if m.err != nil {
+		return m.err
+	}
+	for id, n := range counts {
+		m.counts[id] += n
+	}
+	m.days = append(m.days, day)
+	return nil
+}
+
+func TestViewCounter(t *testing.T) {
+	store := &mockViewStore{counts: map[int]int{}}
+	vc := newViewCounter(store)
+
+	// Repeated views by the same viewer are only counted once.
+	vc.Record(1, "ip:a")
+	vc.Record(1, "ip:a")
+	vc.Record(1, "user:7")
+	vc.Record(2, "ip:a")
+
+	// Nothing is written until the counter is flushed.
+	if len(store.counts) != 0 {
+		t.Fatalf("want no writes before flush; got %v", store.counts)
+	}
+
+	// A failed flush keeps the counts for the next attempt.
+	store.err = errors.New("database is down")
+	if err := vc.Flush(); err == nil {
+		t.Fatal("want flush error")
+	}
+	store.err = nil
+	if err := vc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.counts[1] != 2 || store.counts[2] != 1 {
+		t.Errorf("want counts map[1:2 2:1]; got %v", store.counts)
+	}
+
+	// Flushing again doesn't write the same counts twice.
+	if err := vc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if store.counts[1] != 2 {
+		t.Errorf("want 2 views of snippet 1; got %d", store.counts[1])
+	}
+}
+
+func TestViewCounterDayChange(t *testing.T) {
+	store := &mockViewStore{counts: map[int]int{}, err: errors.New("database is down")}
+	vc := newViewCounter(store)
+
+	// A view is recorded just before midnight.
+	now := time.Date(2020, 12, 17, 23, 59, 0, 0, time.UTC)
+	vc.now = func() time.Time { return now }
+	vc.day = startOfDay(now)
+	yesterday := vc.day
+	vc.Record(1, "ip:a")
+
+	// After midnight, the same viewer is counted again. Recording the view
+	// doesn't write anything, even though the store is down.
+	now = now.Add(2 * time.Minute)
+	vc.Record(1, "ip:a")
+	if !vc.day.Equal(startOfDay(now)) {
+		t.Errorf("want day %s; got %s", startOfDay(now), vc.day)
+	}
+	if len(vc.pending) != 2 {
+		t.Fatalf("want counts pending for 2 days; got %v", vc.pending)
+	}
+
+	// A failed flush keeps each day's counts under that day.
+	if err := vc.Flush(); err == nil {
+		t.Fatal("want flush error")
+	}
+	if vc.pending[yesterday][1] != 1 || vc.pending[vc.day][1] != 1 {
+		t.Fatalf("want 1 view pending on each day; got %v", vc.pending)
+	}
+
+	// Once the store is back, each day's counts are written for that day.
+	store.err = nil
+	if err := vc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if store.counts[1] != 2 || len(store.days) != 2 {
+		t.Errorf("want 2 views of snippet 1 written in 2 batches; got %v in %d", store.counts, len(store.days))
+	}
+	for _, day := range store.days {
+		if !day.Equal(yesterday) && !day.Equal(vc.day) {
+			t.Errorf("want batches for %s and %s; got %s", yesterday, vc.day, day)
+		}
+	}
+}
+
+func TestRunViewFlusherFlushesOnStop(t *testing.T) {
+	store := &mockViewStore{counts: map[int]int{}}
+	app := &application{views: newViewCounter(store)}
+	app.views.Record(1, "ip:a")
+
+	// Stopping the flusher before its first tick still writes the pending
+	// counts, so that they aren't lost on shutdown.
+	done := make(chan struct{})
+	close(done)
+	app.runViewFlusher(time.Hour, done)
+
+	if store.counts[1] != 1 {
+		t.Errorf("want 1 view flushed; got %v", store.counts)
+	}
+}
@@ -1,3 +1,6 @@
+-- This script creates the current schema for a new database. When changing
+-- the schema, also add a script to migrations/ which upgrades an existing one.
+
 -- Create a new UTF-8 `snippetbox` database.
 CREATE DATABASE IF NOT EXISTS snippetbox CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
 
@@ -10,7 +13,13 @@ id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
 title VARCHAR(100) NOT NULL,
 content TEXT NOT NULL,
 created DATETIME NOT NULL,
-expires DATETIME NOT NULL
+expires DATETIME NOT NULL,
+user_id INTEGER,
+private BOOLEAN NOT NULL DEFAULT FALSE,
+hashed_password VARCHAR(255),
+encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+ciphertext MEDIUMTEXT,
+cipher_meta VARCHAR(255)
 );
 
 -- Add an index on the created column.
@@ -45,7 +54,125 @@ CREATE TABLE users (
 id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
 name VARCHAR(255) NOT NULL,
 email VARCHAR(255) NOT NULL,
-hashed_password CHAR(60) NOT NULL,
-created DATETIME NOT NULL
+hashed_password VARCHAR(255),
+created DATETIME NOT NULL,
+email_verified_at DATETIME,
+session_version INTEGER NOT NULL DEFAULT 1,
+totp_secret VARCHAR(32),
+totp_last_counter BIGINT,
+role VARCHAR(16) NOT NULL DEFAULT 'user',
+disabled BOOLEAN NOT NULL DEFAULT FALSE
 );
 ALTER TABLE users ADD CONSTRAINT users_uc_email UNIQUE (email);
+
+-- Create a `stars` table. Each user can star a given snippet at most once, so
+-- the (user_id, snippet_id) pair is used as the primary key.
+CREATE TABLE stars (
+user_id INTEGER NOT NULL,
+snippet_id INTEGER NOT NULL,
+created DATETIME NOT NULL,
+PRIMARY KEY (user_id, snippet_id)
+);
+
+-- Add an index for counting the stars on a snippet within a time window.
+CREATE INDEX idx_stars_snippet_created ON stars(snippet_id, created);
+
+-- Create a `comments` table. Replies point at their top-level comment through
+-- parent_id, which is NULL for top-level comments.
+CREATE TABLE comments (
+id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+snippet_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+parent_id INTEGER,
+content TEXT NOT NULL,
+created DATETIME NOT NULL,
+updated DATETIME NOT NULL
+);
+
+CREATE INDEX idx_comments_snippet_created ON comments(snippet_id, created);
+
+-- Create a `snippet_views` table holding the number of (de-duplicated) views
+-- each snippet received per day.
+CREATE TABLE snippet_views (
+snippet_id INTEGER NOT NULL,
+day DATE NOT NULL,
+views INTEGER NOT NULL,
+PRIMARY KEY (snippet_id, day)
+);
+
+-- Create a `tokens` table for single-use tokens, such as password reset links.
+-- Only a SHA-256 hash of each token is stored, and the scope records what the
+-- token may be used for.
+CREATE TABLE tokens (
+hash CHAR(64) NOT NULL PRIMARY KEY,
+user_id INTEGER NOT NULL,
+scope VARCHAR(32) NOT NULL,
+expires DATETIME NOT NULL
+);
+
+CREATE INDEX idx_tokens_user_scope ON tokens(user_id, scope);
+
+-- Create a `login_attempts` table, which records failed logins per client IP
+-- or account so that the lockouts can be shared between instances. Keys are
+-- stored as SHA-256 hashes.
+CREATE TABLE login_attempts (
+key_hash CHAR(64) NOT NULL PRIMARY KEY,
+failures INTEGER NOT NULL,
+last_failure DATETIME NOT NULL
+);
+
+-- Create a `recovery_codes` table holding SHA-256 hashes of the one-time
+-- recovery codes for users with two-factor authentication enabled.
+CREATE TABLE recovery_codes (
+user_id INTEGER NOT NULL,
+hash CHAR(64) NOT NULL,
+PRIMARY KEY (user_id, hash)
+);
+
+-- Create a `sessions` table recording the active login sessions of each user,
+-- so that they can be listed and revoked. Only a SHA-256 hash of the session
+-- token (which is kept in the session cookie) is stored.
+CREATE TABLE sessions (
+id CHAR(64) NOT NULL PRIMARY KEY,
+user_id INTEGER NOT NULL,
+ip VARCHAR(45) NOT NULL,
+user_agent VARCHAR(255) NOT NULL,
+created DATETIME NOT NULL,
+last_seen DATETIME NOT NULL,
+expires DATETIME NOT NULL
+);
+
+CREATE INDEX idx_sessions_user ON sessions(user_id);
+
+-- Create a `remember_tokens` table holding the persistent "remember me" login
+-- tokens. Each token is a selector, used to look it up, and a validator, of
+-- which only a SHA-256 hash is stored. The session_id column links the token
+-- to the login session it last established, so that signing that session out
+-- revokes the token too. When the token is rotated, the hash of the validator
+-- it replaced is kept for a little while in previous_validator_hash, so that
+-- concurrent requests using the old one aren't mistaken for theft.
+CREATE TABLE remember_tokens (
+selector CHAR(16) NOT NULL PRIMARY KEY,
+validator_hash CHAR(64) NOT NULL,
+previous_validator_hash CHAR(64),
+rotated DATETIME,
+user_id INTEGER NOT NULL,
+session_id CHAR(64) NOT NULL,
+expires DATETIME NOT NULL
+);
+
+CREATE INDEX idx_remember_tokens_user ON remember_tokens(user_id);
+
+-- Create a `user_identities` table linking users to their accounts with
+-- external OpenID Connect providers. An identity is the (issuer, subject) pair
+-- from the provider's ID tokens, and each user can have at most one identity
+-- with each provider.
+CREATE TABLE user_identities (
+issuer VARCHAR(255) NOT NULL,
+subject VARCHAR(255) NOT NULL,
+user_id INTEGER NOT NULL,
+created DATETIME NOT NULL,
+PRIMARY KEY (issuer, subject)
+);
+
+ALTER TABLE user_identities ADD CONSTRAINT user_identities_uc_user_issuer UNIQUE (user_id, issuer);
@@ -0,0 +1,13 @@
+-- Add snippet stars.
+
+-- Create a `stars` table. Each user can star a given snippet at most once, so
+-- the (user_id, snippet_id) pair is used as the primary key.
+CREATE TABLE stars (
+user_id INTEGER NOT NULL,
+snippet_id INTEGER NOT NULL,
+created DATETIME NOT NULL,
+PRIMARY KEY (user_id, snippet_id)
+);
+
+-- Add an index for counting the stars on a snippet within a time window.
+CREATE INDEX idx_stars_snippet_created ON stars(snippet_id, created);
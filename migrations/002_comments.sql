@@ -0,0 +1,20 @@
+-- Add snippet owners, private snippets and threaded comments.
+
+-- Existing snippets have no owner, and stay public.
+ALTER TABLE snippets
+ADD COLUMN user_id INTEGER,
+ADD COLUMN private BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Create a `comments` table. Replies point at their top-level comment through
+-- parent_id, which is NULL for top-level comments.
+CREATE TABLE comments (
+id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+snippet_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+parent_id INTEGER,
+content TEXT NOT NULL,
+created DATETIME NOT NULL,
+updated DATETIME NOT NULL
+);
+
+CREATE INDEX idx_comments_snippet_created ON comments(snippet_id, created);
@@ -0,0 +1,3 @@
+-- Add optional password protection for snippets.
+
+ALTER TABLE snippets ADD COLUMN hashed_password CHAR(60);
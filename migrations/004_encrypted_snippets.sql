@@ -0,0 +1,6 @@
+-- Add client-side encrypted snippets.
+
+ALTER TABLE snippets
+ADD COLUMN encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+ADD COLUMN ciphertext MEDIUMTEXT,
+ADD COLUMN cipher_meta VARCHAR(255);
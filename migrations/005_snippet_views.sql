@@ -0,0 +1,10 @@
+-- Add daily snippet view counts.
+
+-- Create a `snippet_views` table holding the number of (de-duplicated) views
+-- each snippet received per day.
+CREATE TABLE snippet_views (
+snippet_id INTEGER NOT NULL,
+day DATE NOT NULL,
+views INTEGER NOT NULL,
+PRIMARY KEY (snippet_id, day)
+);
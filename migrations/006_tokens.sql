@@ -0,0 +1,13 @@
+-- Add single-use tokens, for password reset links.
+
+-- Create a `tokens` table for single-use tokens, such as password reset links.
+-- Only a SHA-256 hash of each token is stored, and the scope records what the
+-- token may be used for.
+CREATE TABLE tokens (
+hash CHAR(64) NOT NULL PRIMARY KEY,
+user_id INTEGER NOT NULL,
+scope VARCHAR(32) NOT NULL,
+expires DATETIME NOT NULL
+);
+
+CREATE INDEX idx_tokens_user_scope ON tokens(user_id, scope);
@@ -0,0 +1,5 @@
+-- Add email address verification.
+
+-- Existing users haven't verified their address, so they're asked to before
+-- they can create snippets.
+ALTER TABLE users ADD COLUMN email_verified_at DATETIME;
@@ -0,0 +1,4 @@
+-- Add session versions, which log users out everywhere when their password
+-- changes.
+
+ALTER TABLE users ADD COLUMN session_version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,10 @@
+-- Add login rate limiting.
+
+-- Create a `login_attempts` table, which records failed logins per client IP
+-- or account so that the lockouts can be shared between instances. Keys are
+-- stored as SHA-256 hashes.
+CREATE TABLE login_attempts (
+key_hash CHAR(64) NOT NULL PRIMARY KEY,
+failures INTEGER NOT NULL,
+last_failure DATETIME NOT NULL
+);
@@ -0,0 +1,13 @@
+-- Add TOTP two-factor authentication.
+
+ALTER TABLE users
+ADD COLUMN totp_secret VARCHAR(32),
+ADD COLUMN totp_last_counter BIGINT;
+
+-- Create a `recovery_codes` table holding SHA-256 hashes of the one-time
+-- recovery codes for users with two-factor authentication enabled.
+CREATE TABLE recovery_codes (
+user_id INTEGER NOT NULL,
+hash CHAR(64) NOT NULL,
+PRIMARY KEY (user_id, hash)
+);
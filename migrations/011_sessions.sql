@@ -0,0 +1,17 @@
+-- Add server-side login sessions. Users who were logged in before have no
+-- login session, so they're asked to log in again.
+
+-- Create a `sessions` table recording the active login sessions of each user,
+-- so that they can be listed and revoked. Only a SHA-256 hash of the session
+-- token (which is kept in the session cookie) is stored.
+CREATE TABLE sessions (
+id CHAR(64) NOT NULL PRIMARY KEY,
+user_id INTEGER NOT NULL,
+ip VARCHAR(45) NOT NULL,
+user_agent VARCHAR(255) NOT NULL,
+created DATETIME NOT NULL,
+last_seen DATETIME NOT NULL,
+expires DATETIME NOT NULL
+);
+
+CREATE INDEX idx_sessions_user ON sessions(user_id);
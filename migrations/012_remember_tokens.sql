@@ -0,0 +1,20 @@
+-- Add "remember me" logins.
+
+-- Create a `remember_tokens` table holding the persistent "remember me" login
+-- tokens. Each token is a selector, used to look it up, and a validator, of
+-- which only a SHA-256 hash is stored. The session_id column links the token
+-- to the login session it last established, so that signing that session out
+-- revokes the token too. When the token is rotated, the hash of the validator
+-- it replaced is kept for a little while in previous_validator_hash, so that
+-- concurrent requests using the old one aren't mistaken for theft.
+CREATE TABLE remember_tokens (
+selector CHAR(16) NOT NULL PRIMARY KEY,
+validator_hash CHAR(64) NOT NULL,
+previous_validator_hash CHAR(64),
+rotated DATETIME,
+user_id INTEGER NOT NULL,
+session_id CHAR(64) NOT NULL,
+expires DATETIME NOT NULL
+);
+
+CREATE INDEX idx_remember_tokens_user ON remember_tokens(user_id);
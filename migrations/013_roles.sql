@@ -0,0 +1,6 @@
+-- Add user roles and disabled accounts. Existing users are ordinary users;
+-- use "snippetbox user promote" to make someone an admin.
+
+ALTER TABLE users
+ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'user',
+ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,18 @@
+-- Add OpenID Connect logins. Users who sign up through a provider don't have a
+-- password, so hashed_password may now be NULL.
+
+ALTER TABLE users MODIFY hashed_password CHAR(60);
+
+-- Create a `user_identities` table linking users to their accounts with
+-- external OpenID Connect providers. An identity is the (issuer, subject) pair
+-- from the provider's ID tokens, and each user can have at most one identity
+-- with each provider.
+CREATE TABLE user_identities (
+issuer VARCHAR(255) NOT NULL,
+subject VARCHAR(255) NOT NULL,
+user_id INTEGER NOT NULL,
+created DATETIME NOT NULL,
+PRIMARY KEY (issuer, subject)
+);
+
+ALTER TABLE user_identities ADD CONSTRAINT user_identities_uc_user_issuer UNIQUE (user_id, issuer);
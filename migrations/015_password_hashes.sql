@@ -0,0 +1,5 @@
+-- Make password hashing configurable. Argon2id hashes are longer than bcrypt
+-- ones, so the column is widened. Existing bcrypt hashes still work, and are
+-- replaced when their users next log in if the policy has changed.
+
+ALTER TABLE users MODIFY hashed_password VARCHAR(255);
@@ -0,0 +1,5 @@
+-- Hash snippet passwords with the configured password policy too. Argon2id
+-- hashes are longer than bcrypt ones, so the column is widened to match the
+-- users table. Existing bcrypt hashes still work.
+
+ALTER TABLE snippets MODIFY hashed_password VARCHAR(255);
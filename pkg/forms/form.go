@@ -58,6 +58,20 @@ func (f *Form) MaxLength(field string, d int) {
 	}
 }
 
+// Implement a MaxBytes method to check that a specific field in the form is
+// no longer than a maximum number of bytes. Use it rather than MaxLength when
+// the limit comes from how the value is stored or hashed, as characters
+// outside ASCII take more than one byte.
+func (f *Form) MaxBytes(field string, d int) {
+	value := f.Get(field)
+	if value == "" {
+		return
+	}
+	if len(value) > d {
+		f.Errors.Add(field, fmt.Sprintf("This field is too long (maximum is %d bytes)", d))
+	}
+}
+
 // Implement a PermittedValues method to check that a specific field in the form
 // matches one of a set of specific permitted values. If the check fails
 // then add the appropriate message to the form errors.
@@ -0,0 +1,31 @@
+package forms
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMaxBytes(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{name: "Empty", value: "", valid: true},
+		{name: "At the limit", value: strings.Repeat("a", 72), valid: true},
+		{name: "Too long", value: strings.Repeat("a", 73), valid: false},
+		// 37 characters, but 74 bytes.
+		{name: "Too long in bytes", value: strings.Repeat("é", 37), valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := New(url.Values{"password": {tt.value}})
+			form.MaxBytes("password", 72)
+			if form.Valid() != tt.valid {
+				t.Errorf("want valid %t; got errors %v", tt.valid, form.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package forms
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Embed the bundled list of common passwords into the binary.
+//
+//go:embed common-passwords.txt
+var commonPasswordList string
+
+// Parse the common password list once at startup into a set.
+var commonPasswords = func() map[string]bool {
+	set := map[string]bool{}
+	for _, line := range strings.Split(commonPasswordList, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			set[line] = true
+		}
+	}
+	return set
+}()
+
+// Define a PasswordPolicy type which holds the rules new passwords must
+// follow. Breached is optional.
+type PasswordPolicy struct {
+	MinLength  int
+	MinEntropy float64
+	Breached   *BreachedPasswords
+}
+
+// MaxPasswordBytes is the longest password we accept, in bytes. It's the most
+// that bcrypt can hash, and it applies whatever the policy.
+const MaxPasswordBytes = 72
+
+// DefaultPasswordPolicy holds the rules used when no dataset of breached
+// passwords is available.
+var DefaultPasswordPolicy = &PasswordPolicy{MinLength: 10, MinEntropy: 40}
+
+// Check returns a message describing the first problem with a password, or an
+// empty string if it follows the policy. The personal values (like the
+// user's name and email address) must not appear in the password. An error
+// is only returned if the breached password dataset couldn't be read.
+func (p *PasswordPolicy) Check(password string, personal ...string) (string, error) {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Sprintf("This field is too short (minimum is %d)", p.MinLength), nil
+	}
+	// The maximum counts bytes rather than characters, so it's lower for
+	// passwords using characters outside ASCII.
+	if len(password) > MaxPasswordBytes {
+		return fmt.Sprintf("This field is too long (maximum is %d bytes)", MaxPasswordBytes), nil
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return "This password is too common", nil
+	}
+
+	for _, value := range personalParts(personal) {
+		if strings.Contains(lower, value) {
+			return "This password must not contain your name or email address", nil
+		}
+	}
+
+	if bits := PasswordEntropy(password); bits < p.MinEntropy {
+		return fmt.Sprintf("This password is too easy to guess (strength: %s)", PasswordStrength(bits)), nil
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return "", err
+		}
+		if breached {
+			return "This password has appeared in a data breach, so please choose another", nil
+		}
+	}
+
+	return "", nil
+}
+
+// The personalParts function breaks the personal values down into the lower
+// case parts we look for in passwords: each value itself, the local part of
+// email addresses, and each word of names. Parts shorter than 3 characters
+// are ignored, as they'd match too many passwords by chance.
+func personalParts(values []string) []string {
+	parts := []string{}
+	add := func(part string) {
+		if utf8.RuneCountInString(part) >= 3 {
+			parts = append(parts, part)
+		}
+	}
+
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+		add(value)
+		if local, _, ok := strings.Cut(value, "@"); ok {
+			add(local)
+			continue
+		}
+		words := strings.FieldsFunc(value, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if len(words) > 1 {
+			for _, word := range words {
+				add(word)
+			}
+		}
+	}
+	return parts
+}
+
+// PasswordEntropy estimates the strength of a password in bits. It's based
+// on the size of the alphabet the password draws from and its length, but
+// characters which repeat or continue a sequence (like "aaa" or "abc")
+// count for less, as they add little to the effort of guessing it.
+func PasswordEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	var length float64
+	var prev rune
+	for i, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+
+		switch {
+		case i > 0 && r == prev:
+			length += 0.25
+		case i > 0 && (r == prev+1 || r == prev-1):
+			length += 0.5
+		default:
+			length++
+		}
+		prev = r
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return length * math.Log2(float64(pool))
+}
+
+// PasswordStrength describes an entropy estimate from PasswordEntropy in
+// words.
+func PasswordStrength(bits float64) string {
+	switch {
+	case bits < 40:
+		return "weak"
+	case bits < 60:
+		return "fair"
+	case bits < 80:
+		return "strong"
+	default:
+		return "very strong"
+	}
+}
+
+// Define a BreachedPasswords type to look passwords up in an offline copy of
+// a breached password dataset, split by hash prefix like the k-anonymity
+// "range" API of Have I Been Pwned. The directory holds one file for each
+// 5 character prefix of the upper case hex SHA-1 hashes (like "21BD1"), with
+// a line for each hash with that prefix, of the form "SUFFIX:COUNT". Only
+// the file for the password's prefix is read.
+type BreachedPasswords struct {
+	dir string
+}
+
+// LoadBreachedPasswords returns a BreachedPasswords for the dataset in the
+// given directory.
+func LoadBreachedPasswords(dir string) (*BreachedPasswords, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("forms: breached password dataset %s must be a directory", dir)
+	}
+	return &BreachedPasswords{dir: dir}, nil
+}
+
+// Contains reports whether the password is in the dataset.
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(b.dir, prefix))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s, _, _ := strings.Cut(scanner.Text(), ":")
+		if strings.EqualFold(strings.TrimSpace(s), suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// Implement a Password method to check that a specific field in the form
+// holds a password which follows the policy. If the check fails then add the
+// appropriate message to the form errors. The personal values (like the
+// user's name and email address) must not appear in the password.
+func (f *Form) Password(field string, policy *PasswordPolicy, personal ...string) error {
+	value := f.Get(field)
+	if value == "" {
+		return nil
+	}
+	problem, err := policy.Check(value, personal...)
+	if err != nil {
+		return err
+	}
+	if problem != "" {
+		f.Errors.Add(field, problem)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package forms
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{name: "Valid", password: "zebra-mango-quilt", want: ""},
+		{name: "Too short", password: "k8#Lp2", want: "too short"},
+		{name: "Too long", password: strings.Repeat("zebra-mango-quilt-", 4) + "k8#", want: "too long"},
+		{name: "Too long in bytes", password: strings.Repeat("zèbra-mängo-qüilt-", 4), want: "too long"},
+		{name: "Common", password: "Password123", want: "too common"},
+		{name: "Name", password: "AliceInWonderland7", want: "name or email"},
+		{name: "Email", password: "my-alice.smith-pass", want: "name or email"},
+		{name: "Repetitive", password: "xxxxxxxxxxxx", want: "too easy to guess"},
+		{name: "Sequence", password: "abcdefghijk", want: "too easy to guess"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DefaultPasswordPolicy.Check(tt.password, "Alice Smith", "alice.smith@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" && got != "" {
+				t.Errorf("want no problem; got %q", got)
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("want problem containing %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPasswordEntropy(t *testing.T) {
+	// Longer passwords and bigger alphabets are stronger, while repeats and
+	// sequences add little.
+	if PasswordEntropy("correct horse battery staple") <= PasswordEntropy("kjhsdf8723") {
+		t.Error("want passphrase to be stronger than a short password")
+	}
+	if PasswordEntropy("aaaaaaaaaaaa") >= PasswordEntropy("akqmzpwhrtcv") {
+		t.Error("want repeated characters to be weaker than random ones")
+	}
+	if PasswordEntropy("") != 0 {
+		t.Error("want empty password to have no entropy")
+	}
+	if got := PasswordStrength(PasswordEntropy("correct horse battery staple")); got != "very strong" {
+		t.Errorf("want very strong; got %q", got)
+	}
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	// Put the hash suffix of the password in the file for its prefix, among
+	// others, in lower case to check the comparison ignores case.
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("zebra-mango-quilt"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	data := "0000000000000000000000000000000000A:3\r\n" + strings.ToLower(hash[5:]) + ":12\r\n"
+	err := os.WriteFile(filepath.Join(dir, hash[:5]), []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breached, err := LoadBreachedPasswords(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &PasswordPolicy{MinLength: 10, MinEntropy: 40, Breached: breached}
+
+	form := New(url.Values{"password": []string{"zebra-mango-quilt"}})
+	err = form.Password("password", policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(form.Errors.Get("password"), "data breach") {
+		t.Errorf("want breached password to be rejected; got %q", form.Errors.Get("password"))
+	}
+
+	// Passwords whose prefix file doesn't exist aren't breached.
+	form = New(url.Values{"password": []string{"pelican-violet-anchor"}})
+	err = form.Password("password", policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !form.Valid() {
+		t.Errorf("want password to be accepted; got %q", form.Errors.Get("password"))
+	}
+
+	if _, err := LoadBreachedPasswords(filepath.Join(dir, "missing")); err == nil {
+		t.Error("want error for a missing dataset")
+	}
+}
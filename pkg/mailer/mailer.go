@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define a Mailer interface which is satisfied by anything that can send a
+// plain-text email. This lets us swap between sending real emails over SMTP
+// and simply logging them during development and testing.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// The message function formats an email, including its headers, so that it
+// is ready to be sent or logged.
+func message(from, to, subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Define an SMTP type which sends emails through an SMTP server, using PLAIN
+// authentication if a username is set.
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Sender   string
+}
+
+// Implement the Send method for the SMTP mailer.
+func (m *SMTP) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	// The sender may include a display name, but the SMTP envelope needs
+	// just the address.
+	from, err := mail.ParseAddress(m.Sender)
+	if err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
+	return smtp.SendMail(addr, auth, from.Address, []string{to}, message(m.Sender, to, subject, body))
+}
+
+// Define a Log type which writes emails to an io.Writer instead of sending
+// them. Pointing it at os.Stdout or a file is handy during development, and
+// at a buffer during tests.
+type Log struct {
+	mu     sync.Mutex
+	Out    io.Writer
+	Sender string
+}
+
+// Implement the Send method for the Log mailer.
+func (m *Log) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := fmt.Fprintf(m.Out, "%s\r\n\r\n", message(m.Sender, to, subject, body))
+	return err
+}
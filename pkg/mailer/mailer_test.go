@@ -0,0 +1,29 @@
+package mailer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLogMailer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	m := &Log{Out: buf, Sender: "Snippetbox <no-reply@example.com>"}
+
+	err := m.Send("alice@example.com", "Hello", "First line\nSecond line")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := buf.String()
+	for _, want := range []string{
+		"From: Snippetbox <no-reply@example.com>\r\n",
+		"To: alice@example.com\r\n",
+		"Subject: Hello\r\n",
+		"\r\n\r\nFirst line\r\nSecond line",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want email to contain %q; got %q", want, got)
+		}
+	}
+}
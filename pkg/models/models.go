@@ -13,14 +13,120 @@ var (
 	// Add a new ErrDuplicateEmail error. We'll use this later if a user
 	// tries to signup with an email address that's already in use.
 	ErrDuplicateEmail = errors.New("models: duplicate email")
+	// Add a new ErrAccountDisabled error. We'll use this if a user whose
+	// account has been disabled by a moderator tries to login.
+	ErrAccountDisabled = errors.New("models: account disabled")
+	// Add a new ErrDuplicateIdentity error. We'll use this if an external
+	// identity is already linked to a user, or the user already has an
+	// identity with the same provider.
+	ErrDuplicateIdentity = errors.New("models: duplicate identity")
 )
 
+// Define the roles a user can have. Each role can do everything the roles
+// before it can: moderators can manage snippets and disable users, while
+// admins can also delete users.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Roles lists the valid roles, from least to most privileged.
+var Roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+// The roleRank function returns the position of a role in Roles, or -1 if
+// it isn't a valid role.
+func roleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValidRole reports whether role is one of the valid roles.
+func ValidRole(role string) bool {
+	return roleRank(role) >= 0
+}
+
 type Snippet struct {
 	ID      int
 	Title   string
 	Content string
 	Created time.Time
 	Expires time.Time
+	// Stars and Views hold the number of stars and views the snippet has
+	// received. They are only populated by the queries which count them.
+	Stars int
+	Views int
+	// UserID holds the ID of the user who created the snippet, or zero if
+	// the snippet has no owner.
+	UserID  int
+	Private bool
+	// HashedPassword holds the bcrypt hash of the snippet's password, or nil
+	// if the snippet isn't password-protected.
+	HashedPassword []byte
+	// Encrypted is set for snippets which were encrypted in the browser. Their
+	// content is empty; the ciphertext is only ever served by the API.
+	Encrypted bool
+}
+
+// Define a Session type to hold an active login session. The ID is a hash of
+// the token kept in the session cookie, so it's safe to show and use as a
+// handle for revoking the session.
+type Session struct {
+	ID        string
+	UserID    int
+	IP        string
+	UserAgent string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+}
+
+// Define a RememberToken type to hold a persistent "remember me" login token.
+// Only a hash of the token's validator is stored. Once the token has been
+// rotated, PreviousValidatorHash holds the hash of the validator it replaced,
+// and Rotated when that happened.
+type RememberToken struct {
+	Selector              string
+	ValidatorHash         string
+	PreviousValidatorHash string
+	Rotated               time.Time
+	UserID                int
+	SessionID             string
+	Expires               time.Time
+}
+
+// Define a DailyViews type to hold the number of views on a given day.
+type DailyViews struct {
+	Day   time.Time
+	Views int
+}
+
+// Define a Ciphertext type to hold the opaque ciphertext of an encrypted
+// snippet, along with the metadata the browser needs to decrypt it.
+type Ciphertext struct {
+	SnippetID  int       `json:"id"`
+	Ciphertext string    `json:"ciphertext"`
+	Meta       string    `json:"meta"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+}
+
+// Define a Comment type to hold a comment on a snippet. Top-level comments
+// have a zero ParentID and carry their replies in the Replies field.
+type Comment struct {
+	ID        int
+	SnippetID int
+	UserID    int
+	UserName  string
+	ParentID  int
+	Content   string
+	Created   time.Time
+	Updated   time.Time
+	Replies   []*Comment
 }
 
 // Define a new User type. Notice how the field names and types align
@@ -31,4 +137,88 @@ type User struct {
 	Email          string
 	HashedPassword []byte
 	Created        time.Time
+	// HasPassword is set for users who can log in with a password. Users who
+	// signed up through an external identity provider don't have one.
+	HasPassword bool
+	// EmailVerifiedAt holds the time the user verified their email address,
+	// or the zero time if they haven't yet.
+	EmailVerifiedAt time.Time
+	// SessionVersion is incremented whenever the user's password changes.
+	// Sessions which were started with an older version are no longer valid.
+	SessionVersion int
+	// TOTPEnabled is set for users who have enabled two-factor
+	// authentication.
+	TOTPEnabled bool
+	// Role is one of RoleUser, RoleModerator or RoleAdmin.
+	Role string
+	// Disabled is set for users whose account has been disabled by a
+	// moderator. They can't log in.
+	Disabled bool
+}
+
+// HasRole reports whether the user has the given role, or a more privileged
+// one.
+func (u *User) HasRole(role string) bool {
+	return roleRank(role) >= 0 && roleRank(u.Role) >= roleRank(role)
+}
+
+// Define an Export type to hold a copy of everything a user has given us,
+// which they can download from their account page. The fields have JSON tags
+// because the export is delivered as a JSON document.
+type Export struct {
+	Exported   time.Time          `json:"exported"`
+	User       ExportedUser       `json:"user"`
+	Identities []ExportedIdentity `json:"identities"`
+	Snippets   []ExportedSnippet  `json:"snippets"`
+	Comments   []ExportedComment  `json:"comments"`
+	// Starred holds the IDs of the snippets the user has starred.
+	Starred []int `json:"starred_snippet_ids"`
+}
+
+// Define an ExportedUser type to hold a user's profile in an Export. The
+// password hash and two-factor authentication secret are left out.
+type ExportedUser struct {
+	ID               int        `json:"id"`
+	Name             string     `json:"name"`
+	Email            string     `json:"email"`
+	Created          time.Time  `json:"created"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at,omitempty"`
+	Role             string     `json:"role"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+}
+
+// Define an ExportedIdentity type to hold an external identity linked to a
+// user in an Export.
+type ExportedIdentity struct {
+	Issuer  string    `json:"issuer"`
+	Subject string    `json:"subject"`
+	Created time.Time `json:"created"`
+}
+
+// Define an ExportedSnippet type to hold one of a user's snippets in an
+// Export, including any which are private or have expired. Encrypted
+// snippets are exported as the ciphertext and metadata the browser needs to
+// decrypt them.
+type ExportedSnippet struct {
+	ID                int       `json:"id"`
+	Title             string    `json:"title"`
+	Content           string    `json:"content"`
+	Created           time.Time `json:"created"`
+	Expires           time.Time `json:"expires"`
+	Private           bool      `json:"private"`
+	PasswordProtected bool      `json:"password_protected"`
+	Encrypted         bool      `json:"encrypted"`
+	Ciphertext        string    `json:"ciphertext,omitempty"`
+	CipherMeta        string    `json:"cipher_meta,omitempty"`
+}
+
+// Define an ExportedComment type to hold one of a user's comments in an
+// Export. ParentID is zero for top-level comments.
+type ExportedComment struct {
+	ID        int       `json:"id"`
+	SnippetID int       `json:"snippet_id"`
+	ParentID  int       `json:"parent_id,omitempty"`
+	Content   string    `json:"content"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
 }
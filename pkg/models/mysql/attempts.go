@@ -0,0 +1,60 @@
+package mysql
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Define a LoginAttemptModel type which wraps a sql.DB connection pool. It
+// records failed logins per key (like a client IP or an account), so that
+// login rate limiting works across several instances of the application.
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+// The Get method returns the number of failed attempts for a key and the
+// time of the last one.
+func (m *LoginAttemptModel) Get(key string) (int, time.Time, error) {
+	var failures int
+	var last time.Time
+	stmt := `SELECT failures, last_failure FROM login_attempts WHERE key_hash = ?`
+	err := m.DB.QueryRow(stmt, hashToken(key)).Scan(&failures, &last)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	} else if err != nil {
+		return 0, time.Time{}, err
+	}
+	return failures, last, nil
+}
+
+// The Fail method records a failed attempt for a key at the given time, and
+// returns the new number of failed attempts. If the last failure was longer
+// ago than the window, the earlier failures are forgotten and counting starts
+// afresh. This happens in a single statement, so that concurrent failures
+// are all counted. LAST_INSERT_ID(expr) makes the new count available as the
+// statement's last insert ID, without having to read it back.
+func (m *LoginAttemptModel) Fail(key string, at time.Time, window time.Duration) (int, error) {
+	stmt := `INSERT INTO login_attempts (key_hash, failures, last_failure) VALUES(?, LAST_INSERT_ID(1), ?)
+	ON DUPLICATE KEY UPDATE failures = LAST_INSERT_ID(IF(last_failure < ?, 1, failures + 1)),
+	last_failure = VALUES(last_failure)`
+
+	at = at.UTC()
+	result, err := m.DB.Exec(stmt, hashToken(key), at, at.Add(-window))
+	if err != nil {
+		return 0, err
+	}
+
+	failures, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(failures), nil
+}
+
+// The Reset method forgets about the failed attempts for a key.
+func (m *LoginAttemptModel) Reset(key string) error {
+	stmt := `DELETE FROM login_attempts WHERE key_hash = ?`
+
+	_, err := m.DB.Exec(stmt, hashToken(key))
+	return err
+}
@@ -0,0 +1,50 @@
+package mysql
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptModelFail(t *testing.T) {
+	attempts := &LoginAttemptModel{DB: newTestDB(t)}
+	now := time.Date(2020, 12, 17, 10, 0, 0, 0, time.UTC)
+
+	// Each failure is counted, including concurrent ones.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := attempts.Fail("ip:1.2.3.4", now, time.Hour)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	failures, err := attempts.Fail("ip:1.2.3.4", now.Add(time.Minute), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 11 {
+		t.Errorf("want 11 failures; got %d", failures)
+	}
+	failures, last, err := attempts.Get("ip:1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 11 || !last.Equal(now.Add(time.Minute)) {
+		t.Errorf("want 11 failures, the last at %s; got %d at %s", now.Add(time.Minute), failures, last)
+	}
+
+	// Once the last failure is outside the window, counting starts afresh.
+	failures, err = attempts.Fail("ip:1.2.3.4", now.Add(2*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 1 {
+		t.Errorf("want 1 failure after the window; got %d", failures)
+	}
+}
@@ -0,0 +1,102 @@
+package mysql
+
+import (
+	"database/sql"
+
+	"snippetbox/pkg/models"
+)
+
+// Define a CommentModel type which wraps a sql.DB connection pool.
+type CommentModel struct {
+	DB *sql.DB
+}
+
+// We'll use the Insert method to add a new comment on a snippet. A parentID
+// of zero creates a top-level comment, otherwise the comment is stored as a
+// reply to the given parent.
+func (m *CommentModel) Insert(snippetID, userID, parentID int, content string) (int, error) {
+	stmt := `INSERT INTO comments (snippet_id, user_id, parent_id, content, created, updated)
+	VALUES(?, ?, NULLIF(?, 0), ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())`
+
+	result, err := m.DB.Exec(stmt, snippetID, userID, parentID, content)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// This will return a specific comment based on its id.
+func (m *CommentModel) Get(id int) (*models.Comment, error) {
+	stmt := `SELECT c.id, c.snippet_id, c.user_id, u.name, IFNULL(c.parent_id, 0), c.content, c.created, c.updated
+	FROM comments c INNER JOIN users u ON u.id = c.user_id WHERE c.id = ?`
+
+	c := &models.Comment{}
+	err := m.DB.QueryRow(stmt, id).Scan(&c.ID, &c.SnippetID, &c.UserID, &c.UserName, &c.ParentID, &c.Content, &c.Created, &c.Updated)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// We'll use the Update method to change the content of an existing comment.
+func (m *CommentModel) Update(id int, content string) error {
+	stmt := `UPDATE comments SET content = ?, updated = UTC_TIMESTAMP() WHERE id = ?`
+
+	_, err := m.DB.Exec(stmt, content, id)
+	return err
+}
+
+// We'll use the Delete method to remove a comment. Deleting a top-level
+// comment removes its replies too, so that no orphans are left behind.
+func (m *CommentModel) Delete(id int) error {
+	stmt := `DELETE FROM comments WHERE id = ? OR parent_id = ?`
+
+	_, err := m.DB.Exec(stmt, id, id)
+	return err
+}
+
+// The ForSnippet method returns the top-level comments on a snippet in the
+// order they were made, with the replies to each one attached.
+func (m *CommentModel) ForSnippet(snippetID int) ([]*models.Comment, error) {
+	stmt := `SELECT c.id, c.snippet_id, c.user_id, u.name, IFNULL(c.parent_id, 0), c.content, c.created, c.updated
+	FROM comments c INNER JOIN users u ON u.id = c.user_id
+	WHERE c.snippet_id = ? ORDER BY c.created, c.id`
+
+	rows, err := m.DB.Query(stmt, snippetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Because replies are always created after their parent, a single pass
+	// in creation order is enough to attach every reply to its parent.
+	comments := []*models.Comment{}
+	parents := map[int]*models.Comment{}
+	for rows.Next() {
+		c := &models.Comment{}
+		err = rows.Scan(&c.ID, &c.SnippetID, &c.UserID, &c.UserName, &c.ParentID, &c.Content, &c.Created, &c.Updated)
+		if err != nil {
+			return nil, err
+		}
+		if c.ParentID == 0 {
+			comments = append(comments, c)
+			parents[c.ID] = c
+		} else if parent, ok := parents[c.ParentID]; ok {
+			parent.Replies = append(parent.Replies, c)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return comments, nil
+}
@@ -0,0 +1,17 @@
+package mysql
+
+import (
+	"context"
+	"time"
+)
+
+// The queryContext function returns the context for a single query. If the
+// timeout isn't zero, the query is cancelled once it has run for that long,
+// as well as when the parent context is cancelled (for example because the
+// client went away).
+func queryContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
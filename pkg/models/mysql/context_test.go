@@ -0,0 +1,41 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestModelQueryTimeout(t *testing.T) {
+	f := newTestFixture(t)
+
+	// A query which runs for longer than the model's timeout is cancelled.
+	f.snippets.Timeout = time.Nanosecond
+	_, err := f.snippets.GetContext(context.Background(), f.public)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %v; got %v", context.DeadlineExceeded, err)
+	}
+
+	f.users.Timeout = time.Nanosecond
+	_, err = f.users.GetContext(context.Background(), f.userID)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %v; got %v", context.DeadlineExceeded, err)
+	}
+
+	// Queries are cancelled with the context they're given, too.
+	f.users.Timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = f.users.SearchContext(ctx, "")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("want %v; got %v", context.Canceled, err)
+	}
+
+	// Without a timeout, queries run to completion.
+	f.snippets.Timeout = 0
+	_, err = f.snippets.GetContext(context.Background(), f.public)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,66 @@
+package mysql
+
+import (
+	"database/sql"
+
+	"github.com/go-sql-driver/mysql"
+	"snippetbox/pkg/models"
+)
+
+// Define an IdentityModel type which wraps a sql.DB connection pool.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// This will return the ID of the user linked to the identity with the given
+// issuer and subject, or models.ErrNoRecord if it isn't linked.
+func (m *IdentityModel) Get(issuer, subject string) (int, error) {
+	stmt := `SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?`
+
+	var userID int
+	err := m.DB.QueryRow(stmt, issuer, subject).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrNoRecord
+	} else if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// We'll use the Insert method to link an identity to a user. If the identity
+// is already linked, or the user already has an identity with the issuer,
+// models.ErrDuplicateIdentity is returned.
+func (m *IdentityModel) Insert(issuer, subject string, userID int) error {
+	stmt := `INSERT INTO user_identities (issuer, subject, user_id, created)
+	VALUES(?, ?, ?, UTC_TIMESTAMP())`
+
+	_, err := m.DB.Exec(stmt, issuer, subject, userID)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		return models.ErrDuplicateIdentity
+	}
+	return err
+}
+
+// This will return the issuers of the identities linked to a user.
+func (m *IdentityModel) ForUser(userID int) ([]string, error) {
+	rows, err := m.DB.Query(`SELECT issuer FROM user_identities WHERE user_id = ? ORDER BY created`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	issuers := []string{}
+	for rows.Next() {
+		var issuer string
+		err = rows.Scan(&issuer)
+		if err != nil {
+			return nil, err
+		}
+		issuers = append(issuers, issuer)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return issuers, nil
+}
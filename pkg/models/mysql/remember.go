@@ -0,0 +1,94 @@
+package mysql
+
+import (
+	"database/sql"
+	"time"
+
+	"snippetbox/pkg/models"
+)
+
+// Define a RememberTokenModel type which wraps a sql.DB connection pool.
+type RememberTokenModel struct {
+	DB *sql.DB
+}
+
+// We'll use the Insert method to store a new "remember me" token for a user,
+// which expires after the given time-to-live.
+func (m *RememberTokenModel) Insert(selector, validatorHash string, userID int, sessionID string, ttl time.Duration) error {
+	stmt := `INSERT INTO remember_tokens (selector, validator_hash, user_id, session_id, expires)
+	VALUES(?, ?, ?, ?, DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND))`
+
+	_, err := m.DB.Exec(stmt, selector, validatorHash, userID, sessionID, int(ttl.Seconds()))
+	return err
+}
+
+// This will return the unexpired token with the given selector, or
+// models.ErrNoRecord if there isn't one.
+func (m *RememberTokenModel) Get(selector string) (*models.RememberToken, error) {
+	stmt := `SELECT selector, validator_hash, IFNULL(previous_validator_hash, ''), rotated, user_id, session_id, expires
+	FROM remember_tokens WHERE selector = ? AND expires > UTC_TIMESTAMP()`
+
+	t := &models.RememberToken{}
+	var rotated sql.NullTime
+	err := m.DB.QueryRow(stmt, selector).Scan(&t.Selector, &t.ValidatorHash, &t.PreviousValidatorHash, &rotated, &t.UserID, &t.SessionID, &t.Expires)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+	t.Rotated = rotated.Time
+	return t, nil
+}
+
+// We'll use the Rotate method to replace the validator of a token once it
+// has been used, linking it to the new login session and extending its
+// expiry. The old validator's hash is kept as the previous one, along with
+// the time of the rotation. Rotation is conditional on the old validator, so
+// that if two requests race to use the same token only one of them succeeds;
+// the other gets models.ErrNoRecord.
+func (m *RememberTokenModel) Rotate(selector, oldValidatorHash, validatorHash, sessionID string, ttl time.Duration) error {
+	// MySQL assigns the columns from left to right, so validator_hash is
+	// copied to previous_validator_hash before it's replaced.
+	stmt := `UPDATE remember_tokens SET previous_validator_hash = validator_hash, rotated = UTC_TIMESTAMP(),
+	validator_hash = ?, session_id = ?, expires = DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND)
+	WHERE selector = ? AND validator_hash = ?`
+
+	result, err := m.DB.Exec(stmt, validatorHash, sessionID, int(ttl.Seconds()), selector, oldValidatorHash)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+// We'll use the Delete method to revoke the token with the given selector.
+func (m *RememberTokenModel) Delete(selector string) error {
+	_, err := m.DB.Exec(`DELETE FROM remember_tokens WHERE selector = ?`, selector)
+	return err
+}
+
+// We'll use the DeleteForSession method to revoke a user's token linked to
+// the login session with the given ID.
+func (m *RememberTokenModel) DeleteForSession(userID int, sessionID string) error {
+	_, err := m.DB.Exec(`DELETE FROM remember_tokens WHERE user_id = ? AND session_id = ?`, userID, sessionID)
+	return err
+}
+
+// We'll use the DeleteOthers method to revoke all of a user's tokens except
+// the one linked to the login session with the given ID.
+func (m *RememberTokenModel) DeleteOthers(userID int, sessionID string) error {
+	_, err := m.DB.Exec(`DELETE FROM remember_tokens WHERE user_id = ? AND session_id != ?`, userID, sessionID)
+	return err
+}
+
+// We'll use the DeleteAllForUser method to revoke all of a user's tokens.
+func (m *RememberTokenModel) DeleteAllForUser(userID int) error {
+	_, err := m.DB.Exec(`DELETE FROM remember_tokens WHERE user_id = ?`, userID)
+	return err
+}
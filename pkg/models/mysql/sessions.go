@@ -0,0 +1,132 @@
+package mysql
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	"snippetbox/pkg/models"
+)
+
+// Define a SessionModel type which wraps a sql.DB connection pool.
+type SessionModel struct {
+	DB *sql.DB
+}
+
+// The newSessionToken function returns a new random session token.
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// The truncateRunes function shortens s to at most n characters. It cuts on a
+// character boundary, so that a multi-byte UTF-8 sequence is never split
+// (MySQL would reject the invalid string).
+func truncateRunes(s string, n int) string {
+	i := 0
+	for j := range s {
+		if i == n {
+			return s[:j]
+		}
+		i++
+	}
+	return s
+}
+
+// We'll use the Create method to start a new login session for a user, which
+// expires after the given lifetime. It returns the plain-text session token
+// to be stored in the session cookie; only its hash is stored.
+func (m *SessionModel) Create(userID int, ip, userAgent string, lifetime time.Duration) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	userAgent = truncateRunes(userAgent, 255)
+
+	stmt := `INSERT INTO sessions (id, user_id, ip, user_agent, created, last_seen, expires)
+	VALUES(?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND))`
+
+	_, err = m.DB.Exec(stmt, hashToken(token), userID, ip, userAgent, int(lifetime.Seconds()))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// This will return the unexpired session for a session token, or
+// models.ErrNoRecord if it doesn't exist (for example because it was
+// revoked).
+func (m *SessionModel) Get(token string) (*models.Session, error) {
+	stmt := `SELECT id, user_id, ip, user_agent, created, last_seen, expires FROM sessions
+	WHERE id = ? AND expires > UTC_TIMESTAMP()`
+
+	s := &models.Session{}
+	err := m.DB.QueryRow(stmt, hashToken(token)).Scan(&s.ID, &s.UserID, &s.IP, &s.UserAgent, &s.Created, &s.LastSeen, &s.Expires)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// We'll use the Touch method to record that a session was seen again, and
+// from which IP address.
+func (m *SessionModel) Touch(token, ip string) error {
+	stmt := `UPDATE sessions SET last_seen = UTC_TIMESTAMP(), ip = ? WHERE id = ?`
+
+	_, err := m.DB.Exec(stmt, ip, hashToken(token))
+	return err
+}
+
+// This will return a user's unexpired sessions, most recently seen first.
+func (m *SessionModel) ForUser(userID int) ([]*models.Session, error) {
+	stmt := `SELECT id, user_id, ip, user_agent, created, last_seen, expires FROM sessions
+	WHERE user_id = ? AND expires > UTC_TIMESTAMP() ORDER BY last_seen DESC`
+
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*models.Session{}
+	for rows.Next() {
+		s := &models.Session{}
+		err = rows.Scan(&s.ID, &s.UserID, &s.IP, &s.UserAgent, &s.Created, &s.LastSeen, &s.Expires)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// We'll use the Delete method to revoke the session for a session token.
+func (m *SessionModel) Delete(token string) error {
+	_, err := m.DB.Exec(`DELETE FROM sessions WHERE id = ?`, hashToken(token))
+	return err
+}
+
+// We'll use the DeleteByID method to revoke one of a user's sessions by its
+// ID (the hash shown on the active sessions page).
+func (m *SessionModel) DeleteByID(userID int, id string) error {
+	_, err := m.DB.Exec(`DELETE FROM sessions WHERE user_id = ? AND id = ?`, userID, id)
+	return err
+}
+
+// We'll use the DeleteOthers method to revoke all of a user's sessions
+// except the one for the given session token.
+func (m *SessionModel) DeleteOthers(userID int, token string) error {
+	_, err := m.DB.Exec(`DELETE FROM sessions WHERE user_id = ? AND id != ?`, userID, hashToken(token))
+	return err
+}
@@ -0,0 +1,33 @@
+package mysql
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{"Short", "Firefox", 255, "Firefox"},
+		{"ASCII", strings.Repeat("a", 300), 255, strings.Repeat("a", 255)},
+		{"Multi-byte", strings.Repeat("é", 300), 255, strings.Repeat("é", 255)},
+		{"Boundary", strings.Repeat("a", 254) + "日本", 255, strings.Repeat("a", 254) + "日"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateRunes(tt.s, tt.n)
+			if got != tt.want {
+				t.Errorf("want %q; got %q", tt.want, got)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("want valid UTF-8; got %q", got)
+			}
+		})
+	}
+}
@@ -1,30 +1,65 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
+	"time"
 
 	"snippetbox/pkg/models"
+	"snippetbox/pkg/passwords"
 )
 
 // Define a SnippetModel type which wraps a sql.DB connection pool.
 type SnippetModel struct {
 	DB *sql.DB
+	// Passwords is the policy used to hash snippet passwords. If it's nil,
+	// passwords.Default is used.
+	Passwords *passwords.Hasher
+	// Timeout is how long each query may run before it's cancelled. If it's
+	// zero, queries are only cancelled with the context they're given.
+	Timeout time.Duration
 }
 
-// This will insert a new snippet into the database.
-func (m *SnippetModel) Insert(title, content, expires string) (int, error) {
+func (m *SnippetModel) hasher() *passwords.Hasher {
+	if m.Passwords == nil {
+		return passwords.Default
+	}
+	return m.Passwords
+}
+
+// This will insert a new snippet into the database. If password isn't empty
+// the snippet is protected by it, and only a hash of it is stored.
+func (m *SnippetModel) Insert(title, content, expires string, userID int, private bool, password string) (int, error) {
+	return m.InsertContext(context.Background(), title, content, expires, userID, private, password)
+}
+
+// InsertContext is like Insert, but takes a context for the queries it runs.
+func (m *SnippetModel) InsertContext(ctx context.Context, title, content, expires string, userID int, private bool, password string) (int, error) {
+	var hashedPassword sql.NullString
+	if password != "" {
+		var err error
+		hashedPassword.String, err = m.hasher().Hash(password)
+		if err != nil {
+			return 0, err
+		}
+		hashedPassword.Valid = true
+	}
+
 	// Write the SQL statement we want to execute. I've split it over two lines
 	// for readability (which is why it's surrounded with backquotes instead
 	// of normal double quotes).
-	stmt := `INSERT INTO snippets (title, content, created, expires) 
-	VALUES(?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? DAY))`
-
-	// Use the Exec() method on the embedded connection pool to execute the
-	// statement. The first parameter is the SQL statement, followed by the
-	// title, content and expiry values for the placeholder parameters. This
-	// method returns a sql.Result object, which contains some basic
-	// information about what happened when the statement was executed.
-	result, err := m.DB.Exec(stmt, title, content, expires)
+	stmt := `INSERT INTO snippets (title, content, created, expires, user_id, private, hashed_password)
+	VALUES(?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? DAY), ?, ?, ?)`
+
+	// Use the ExecContext() method on the embedded connection pool to execute
+	// the statement, with a context which is cancelled if it takes too long.
+	// The next parameter is the SQL statement, followed by the title, content
+	// and expiry values for the placeholder parameters. This method returns a
+	// sql.Result object, which contains some basic information about what
+	// happened when the statement was executed.
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(qctx, stmt, title, content, expires, userID, private, hashedPassword)
 	if err != nil {
 		return 0, err
 	}
@@ -43,16 +78,23 @@ func (m *SnippetModel) Insert(title, content, expires string) (int, error) {
 
 // This will return a specific snippet based on its id.
 func (m *SnippetModel) Get(id int) (*models.Snippet, error) {
+	return m.GetContext(context.Background(), id)
+}
+
+// GetContext is like Get, but takes a context for the queries it runs.
+func (m *SnippetModel) GetContext(ctx context.Context, id int) (*models.Snippet, error) {
 	// Write the SQL statement we want to execute. Again, I've split it over two
 	// lines for readability.
-	stmt := `SELECT id, title, content, created, expires FROM snippets
-	WHERE expires > UTC_TIMESTAMP() AND id = ?`
+	stmt := `SELECT id, title, content, created, expires, IFNULL(user_id, 0), private, hashed_password, encrypted
+	FROM snippets WHERE expires > UTC_TIMESTAMP() AND id = ?`
 
-	// Use the QueryRow() method on the connection pool to execute our
+	// Use the QueryRowContext() method on the connection pool to execute our
 	// SQL statement, passing in the untrusted id variable as the value for the
 	// placeholder parameter. This returns a pointer to a sql.Row object which
 	// holds the result from the database.
-	row := m.DB.QueryRow(stmt, id)
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	row := m.DB.QueryRowContext(qctx, stmt, id)
 
 	// Initialize a pointer to a new zeroed Snippet struct.
 	s := &models.Snippet{}
@@ -64,7 +106,7 @@ func (m *SnippetModel) Get(id int) (*models.Snippet, error) {
 	// columns returned by your statement. If the query returns no rows, then
 	// row.Scan() will return a sql.ErrNoRows error. We check for that and return
 	// our own models.ErrNoRecord error instead of a Snippet object.
-	err := row.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires)
+	err := row.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires, &s.UserID, &s.Private, &s.HashedPassword, &s.Encrypted)
 	if err == sql.ErrNoRows {
 		return nil, models.ErrNoRecord
 	} else if err != nil {
@@ -75,16 +117,112 @@ func (m *SnippetModel) Get(id int) (*models.Snippet, error) {
 	return s, nil
 }
 
-// This will return the 10 most recently created snippets.
+// This will insert a new encrypted snippet into the database. The server never
+// sees the plain-text, so the content is left empty and the title is fixed.
+func (m *SnippetModel) InsertEncrypted(ciphertext, meta, expires string, userID int) (int, error) {
+	return m.InsertEncryptedContext(context.Background(), ciphertext, meta, expires, userID)
+}
+
+// InsertEncryptedContext is like InsertEncrypted, but takes a context for the
+// queries it runs.
+func (m *SnippetModel) InsertEncryptedContext(ctx context.Context, ciphertext, meta, expires string, userID int) (int, error) {
+	stmt := `INSERT INTO snippets (title, content, created, expires, user_id, encrypted, ciphertext, cipher_meta)
+	VALUES('Encrypted snippet', '', UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? DAY), ?, TRUE, ?, ?)`
+
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(qctx, stmt, expires, userID, ciphertext, meta)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// This will return the ciphertext of a specific encrypted snippet. Snippets
+// which aren't encrypted are reported as models.ErrNoRecord.
+func (m *SnippetModel) Ciphertext(id int) (*models.Ciphertext, error) {
+	return m.CiphertextContext(context.Background(), id)
+}
+
+// CiphertextContext is like Ciphertext, but takes a context for the queries
+// it runs.
+func (m *SnippetModel) CiphertextContext(ctx context.Context, id int) (*models.Ciphertext, error) {
+	stmt := `SELECT id, ciphertext, cipher_meta, created, expires FROM snippets
+	WHERE expires > UTC_TIMESTAMP() AND encrypted = TRUE AND id = ?`
+
+	c := &models.Ciphertext{}
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(qctx, stmt, id).Scan(&c.SnippetID, &c.Ciphertext, &c.Meta, &c.Created, &c.Expires)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// We'll use the Authenticate method to verify the password of a protected
+// snippet. It returns models.ErrInvalidCredentials if the password doesn't
+// match, or models.ErrNoRecord if the snippet doesn't exist.
+func (m *SnippetModel) Authenticate(id int, password string) error {
+	return m.AuthenticateContext(context.Background(), id, password)
+}
+
+// AuthenticateContext is like Authenticate, but takes a context for the
+// queries it runs.
+func (m *SnippetModel) AuthenticateContext(ctx context.Context, id int, password string) error {
+	var hashedPassword sql.NullString
+	stmt := `SELECT hashed_password FROM snippets WHERE expires > UTC_TIMESTAMP() AND id = ?`
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(qctx, stmt, id).Scan(&hashedPassword)
+	if err == sql.ErrNoRows {
+		return models.ErrNoRecord
+	} else if err != nil {
+		return err
+	}
+
+	// A snippet without a password can't be unlocked with one.
+	if !hashedPassword.Valid {
+		return models.ErrInvalidCredentials
+	}
+
+	match, _, err := m.hasher().Verify(password, hashedPassword.String)
+	if err != nil {
+		return err
+	}
+	if !match {
+		return models.ErrInvalidCredentials
+	}
+	return nil
+}
+
+// This will return the 10 most recently created public snippets. Encrypted
+// snippets are left out, as they can't be read without the key in their link.
 func (m *SnippetModel) Latest() ([]*models.Snippet, error) {
+	return m.LatestContext(context.Background())
+}
+
+// LatestContext is like Latest, but takes a context for the queries it runs.
+func (m *SnippetModel) LatestContext(ctx context.Context) ([]*models.Snippet, error) {
 	// Write the SQL statement we want to execute.
 	stmt := `SELECT id, title, content, created, expires FROM snippets
-WHERE expires > UTC_TIMESTAMP() ORDER BY created DESC LIMIT 10`
+WHERE expires > UTC_TIMESTAMP() AND private = FALSE AND encrypted = FALSE ORDER BY created DESC LIMIT 10`
 
-	// Use the Query() method on the connection pool to execute our
+	// Use the QueryContext() method on the connection pool to execute our
 	// SQL statement. This returns a sql.Rows resultset containing the result of
 	// our query.
-	rows, err := m.DB.Query(stmt)
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(qctx, stmt)
 	if err != nil {
 		return nil, err
 	}
@@ -131,3 +269,145 @@ WHERE expires > UTC_TIMESTAMP() ORDER BY created DESC LIMIT 10`
 	// If everything went OK then return the Snippets slice.
 	return snippets, nil
 }
+
+// This will return the 10 unexpired public snippets which received the most
+// stars in the last week, along with the number of stars they received in that
+// window.
+func (m *SnippetModel) Popular() ([]*models.Snippet, error) {
+	return m.PopularContext(context.Background())
+}
+
+// PopularContext is like Popular, but takes a context for the queries it runs.
+func (m *SnippetModel) PopularContext(ctx context.Context) ([]*models.Snippet, error) {
+	stmt := `SELECT s.id, s.title, s.content, s.created, s.expires, COUNT(*) AS stars
+	FROM snippets s INNER JOIN stars ON stars.snippet_id = s.id
+	WHERE s.expires > UTC_TIMESTAMP() AND s.private = FALSE AND s.encrypted = FALSE AND stars.created > DATE_SUB(UTC_TIMESTAMP(), INTERVAL 7 DAY)
+	GROUP BY s.id ORDER BY stars DESC, s.created DESC LIMIT 10`
+
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(qctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snippets := []*models.Snippet{}
+	for rows.Next() {
+		s := &models.Snippet{}
+		err = rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires, &s.Stars)
+		if err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return snippets, nil
+}
+
+// This will return the unexpired snippets created by a user, newest first,
+// along with their total number of views.
+func (m *SnippetModel) ByUser(userID int) ([]*models.Snippet, error) {
+	return m.ByUserContext(context.Background(), userID)
+}
+
+// ByUserContext is like ByUser, but takes a context for the queries it runs.
+func (m *SnippetModel) ByUserContext(ctx context.Context, userID int) ([]*models.Snippet, error) {
+	stmt := `SELECT s.id, s.title, s.content, s.created, s.expires, s.private, s.encrypted,
+	(SELECT IFNULL(SUM(v.views), 0) FROM snippet_views v WHERE v.snippet_id = s.id)
+	FROM snippets s WHERE s.user_id = ? AND s.expires > UTC_TIMESTAMP()
+	ORDER BY s.created DESC`
+
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(qctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snippets := []*models.Snippet{}
+	for rows.Next() {
+		s := &models.Snippet{UserID: userID}
+		err = rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires, &s.Private, &s.Encrypted, &s.Views)
+		if err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return snippets, nil
+}
+
+// This will return the 50 newest snippets whose title contains the query,
+// including private, encrypted and expired ones, for moderators to review.
+// An empty query matches every snippet.
+func (m *SnippetModel) Search(query string) ([]*models.Snippet, error) {
+	return m.SearchContext(context.Background(), query)
+}
+
+// SearchContext is like Search, but takes a context for the queries it runs.
+func (m *SnippetModel) SearchContext(ctx context.Context, query string) ([]*models.Snippet, error) {
+	stmt := `SELECT id, title, created, expires, IFNULL(user_id, 0), private, encrypted FROM snippets
+	WHERE title LIKE ? ORDER BY created DESC LIMIT 50`
+
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(qctx, stmt, likePattern(query))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snippets := []*models.Snippet{}
+	for rows.Next() {
+		s := &models.Snippet{}
+		err = rows.Scan(&s.ID, &s.Title, &s.Created, &s.Expires, &s.UserID, &s.Private, &s.Encrypted)
+		if err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return snippets, nil
+}
+
+// We'll use the Delete method to remove a snippet, along with the stars,
+// comments and views on it.
+func (m *SnippetModel) Delete(id int) error {
+	return m.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext is like Delete, but takes a context for the queries it runs.
+func (m *SnippetModel) DeleteContext(ctx context.Context, id int) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		`DELETE FROM stars WHERE snippet_id = ?`,
+		`DELETE FROM comments WHERE snippet_id = ?`,
+		`DELETE FROM snippet_views WHERE snippet_id = ?`,
+		`DELETE FROM snippets WHERE id = ?`,
+	} {
+		qctx, cancel := queryContext(ctx, m.Timeout)
+		defer cancel()
+		_, err = tx.ExecContext(qctx, stmt, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,44 @@
+package mysql
+
+import (
+	"testing"
+
+	"snippetbox/pkg/models"
+	"snippetbox/pkg/passwords"
+)
+
+func TestSnippetModelAuthenticate(t *testing.T) {
+	f := newTestFixture(t)
+
+	// Argon2id hashes are longer than bcrypt ones, so this checks that the
+	// column is wide enough for them as well.
+	argon2 := passwords.DefaultArgon2
+	argon2.Memory = 1024
+	f.snippets.Passwords = &passwords.Hasher{Algorithm: passwords.Argon2id, Argon2: argon2}
+
+	id, err := f.snippets.Insert("Protected", "Secret content", "7", f.userID, false, "open sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		id       int
+		password string
+		wantErr  error
+	}{
+		{"Valid password", id, "open sesame", nil},
+		{"Wrong password", id, "let me in", models.ErrInvalidCredentials},
+		{"No password set", f.public, "open sesame", models.ErrInvalidCredentials},
+		{"Missing snippet", 0, "open sesame", models.ErrNoRecord},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := f.snippets.Authenticate(tt.id, tt.password)
+			if err != tt.wantErr {
+				t.Errorf("want %v; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
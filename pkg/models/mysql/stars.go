@@ -0,0 +1,82 @@
+package mysql
+
+import (
+	"database/sql"
+
+	"snippetbox/pkg/models"
+)
+
+// Define a StarModel type which wraps a sql.DB connection pool.
+type StarModel struct {
+	DB *sql.DB
+}
+
+// We'll use the Insert method to star a snippet on behalf of a user. Starring
+// a snippet which is already starred is a no-op, so we use INSERT IGNORE to
+// skip over the duplicate primary key.
+func (m *StarModel) Insert(userID, snippetID int) error {
+	stmt := `INSERT IGNORE INTO stars (user_id, snippet_id, created)
+	VALUES(?, ?, UTC_TIMESTAMP())`
+
+	_, err := m.DB.Exec(stmt, userID, snippetID)
+	return err
+}
+
+// We'll use the Delete method to remove a user's star from a snippet.
+func (m *StarModel) Delete(userID, snippetID int) error {
+	stmt := `DELETE FROM stars WHERE user_id = ? AND snippet_id = ?`
+
+	_, err := m.DB.Exec(stmt, userID, snippetID)
+	return err
+}
+
+// The Count method returns the total number of stars for a specific snippet.
+func (m *StarModel) Count(snippetID int) (int, error) {
+	var count int
+	stmt := `SELECT COUNT(*) FROM stars WHERE snippet_id = ?`
+	err := m.DB.QueryRow(stmt, snippetID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// The Exists method reports whether a user has starred a specific snippet.
+func (m *StarModel) Exists(userID, snippetID int) (bool, error) {
+	var exists bool
+	stmt := `SELECT EXISTS(SELECT true FROM stars WHERE user_id = ? AND snippet_id = ?)`
+	err := m.DB.QueryRow(stmt, userID, snippetID).Scan(&exists)
+	return exists, err
+}
+
+// The Starred method returns the unexpired snippets a user has starred, most
+// recently starred first. Snippets which are private to someone else are
+// left out.
+func (m *StarModel) Starred(userID int) ([]*models.Snippet, error) {
+	stmt := `SELECT s.id, s.title, s.content, s.created, s.expires FROM snippets s
+	INNER JOIN stars ON stars.snippet_id = s.id
+	WHERE stars.user_id = ? AND s.expires > UTC_TIMESTAMP()
+	AND (s.private = FALSE OR s.user_id = ?)
+	ORDER BY stars.created DESC`
+
+	rows, err := m.DB.Query(stmt, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snippets := []*models.Snippet{}
+	for rows.Next() {
+		s := &models.Snippet{}
+		err = rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires)
+		if err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return snippets, nil
+}
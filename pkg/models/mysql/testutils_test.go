@@ -0,0 +1,96 @@
+package mysql
+
+import (
+	"database/sql"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// The tests in this package run against a real MySQL database, given by the
+// SNIPPETBOX_TEST_DSN environment variable, like
+// "test_web:pass@/test_snippetbox?parseTime=true". The tables are created
+// from init.sql before each test and dropped afterwards, so don't point it at
+// a database you care about. If it isn't set, the tests are skipped.
+const testDSNEnv = "SNIPPETBOX_TEST_DSN"
+
+var createTableRX = regexp.MustCompile(`^CREATE TABLE (\w+)`)
+
+// The schemaStatements function returns the statements in init.sql which
+// create the schema, leaving out those which create the database and its user
+// and insert the dummy records. It also returns the names of the tables.
+func schemaStatements(t *testing.T) ([]string, []string) {
+	script, err := os.ReadFile("../../../init.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stmts, tables []string
+	for _, stmt := range strings.Split(string(script), ";\n") {
+		lines := []string{}
+		for _, line := range strings.Split(stmt, "\n") {
+			if !strings.HasPrefix(line, "--") {
+				lines = append(lines, line)
+			}
+		}
+		stmt = strings.TrimSuffix(strings.TrimSpace(strings.Join(lines, "\n")), ";")
+
+		switch {
+		case stmt == "",
+			strings.HasPrefix(stmt, "CREATE DATABASE"),
+			strings.HasPrefix(stmt, "USE "),
+			strings.HasPrefix(stmt, "CREATE USER"),
+			strings.HasPrefix(stmt, "GRANT "),
+			strings.HasPrefix(stmt, "INSERT "):
+			continue
+		}
+		if m := createTableRX.FindStringSubmatch(stmt); m != nil {
+			tables = append(tables, m[1])
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts, tables
+}
+
+// The newTestDB function connects to the test database and creates the
+// schema in it. The tables are dropped and the connection closed when the
+// test finishes.
+func newTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set", testDSNEnv)
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stmts, tables := schemaStatements(t)
+	dropTables := func() {
+		for _, table := range tables {
+			_, err := db.Exec("DROP TABLE IF EXISTS " + table)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Drop any tables left behind by a test which didn't finish.
+	dropTables()
+	t.Cleanup(func() {
+		dropTables()
+		db.Close()
+	})
+
+	for _, stmt := range stmts {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	return db
+}
@@ -0,0 +1,114 @@
+package mysql
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"time"
+
+	"snippetbox/pkg/models"
+)
+
+// Define the scopes which tokens can be issued for.
+const (
+	ScopePasswordReset     = "password-reset"
+	ScopeEmailVerification = "email-verification"
+)
+
+// Define a TokenModel type which wraps a sql.DB connection pool.
+type TokenModel struct {
+	DB *sql.DB
+}
+
+// The hashToken function returns the hex-encoded SHA-256 hash of a plain-text
+// token, which is what we store in the database.
+func hashToken(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// We'll use the New method to issue a new random token for a user, which
+// expires after the given time-to-live. The plain-text token is returned to
+// be sent to the user; only its hash is stored.
+func (m *TokenModel) New(userID int, ttl time.Duration, scope string) (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	plaintext := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	stmt := `INSERT INTO tokens (hash, user_id, scope, expires)
+	VALUES(?, ?, ?, DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND))`
+
+	_, err = m.DB.Exec(stmt, hashToken(plaintext), userID, scope, int(ttl.Seconds()))
+	if err != nil {
+		return "", err
+	}
+
+	return plaintext, nil
+}
+
+// We'll use the Use method to redeem a token. If the token exists for the
+// scope and hasn't expired, it is deleted (so it can only be used once) and
+// the ID of its user is returned. Otherwise models.ErrNoRecord is returned.
+func (m *TokenModel) Use(plaintext, scope string) (int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the row, so that two concurrent requests can't both redeem it.
+	var userID int
+	stmt := `SELECT user_id FROM tokens
+	WHERE hash = ? AND scope = ? AND expires > UTC_TIMESTAMP() FOR UPDATE`
+	err = tx.QueryRow(stmt, hashToken(plaintext), scope).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrNoRecord
+	} else if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM tokens WHERE hash = ?`, hashToken(plaintext))
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// The Check method reports whether a token exists for the scope and hasn't
+// expired, without redeeming it.
+func (m *TokenModel) Check(plaintext, scope string) (bool, error) {
+	var exists bool
+	stmt := `SELECT EXISTS(SELECT true FROM tokens
+	WHERE hash = ? AND scope = ? AND expires > UTC_TIMESTAMP())`
+	err := m.DB.QueryRow(stmt, hashToken(plaintext), scope).Scan(&exists)
+	return exists, err
+}
+
+// The Owner method returns the ID of the user a token was issued to, if it
+// exists for the scope and hasn't expired, without redeeming it. Otherwise
+// models.ErrNoRecord is returned.
+func (m *TokenModel) Owner(plaintext, scope string) (int, error) {
+	var userID int
+	stmt := `SELECT user_id FROM tokens WHERE hash = ? AND scope = ? AND expires > UTC_TIMESTAMP()`
+	err := m.DB.QueryRow(stmt, hashToken(plaintext), scope).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrNoRecord
+	} else if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// The DeleteAllForUser method removes all of a user's tokens for a scope.
+func (m *TokenModel) DeleteAllForUser(userID int, scope string) error {
+	stmt := `DELETE FROM tokens WHERE user_id = ? AND scope = ?`
+
+	_, err := m.DB.Exec(stmt, userID, scope)
+	return err
+}
@@ -1,23 +1,47 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"github.com/go-sql-driver/mysql"
-	"golang.org/x/crypto/bcrypt"
+	"log/slog"
 	"snippetbox/pkg/models"
+	"snippetbox/pkg/passwords"
 	"strings"
+	"time"
 )
 
+// Define a UserModel type which wraps a sql.DB connection pool. Every method
+// takes a context, and its queries are cancelled when the context is, or when
+// they run for longer than Timeout.
 type UserModel struct {
 	DB *sql.DB
+	// Passwords is the policy used to hash passwords. If it's nil,
+	// passwords.Default is used.
+	Passwords *passwords.Hasher
+	// Timeout is how long each query may run before it's cancelled. If it's
+	// zero, queries are only cancelled with the context they're given.
+	Timeout time.Duration
+	// Logger is where errors which don't stop a request, such as a failed
+	// password rehash, are logged. If it's nil, they aren't logged.
+	Logger *slog.Logger
 }
 
-// We'll use the Insert method to add a new record to the users table.
-func (m *UserModel) Insert(name, email, password string) error {
-	// Create a bcrypt hash of the plain-text password.
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+// The hasher method returns the password hashing policy to use.
+func (m *UserModel) hasher() *passwords.Hasher {
+	if m.Passwords == nil {
+		return passwords.Default
+	}
+	return m.Passwords
+}
+
+// We'll use the InsertContext method to add a new record to the users table.
+// It returns the ID of the new user.
+func (m *UserModel) InsertContext(ctx context.Context, name, email, password string) (int, error) {
+	// Create a hash of the plain-text password.
+	hashedPassword, err := m.hasher().Hash(password)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	stmt := `INSERT INTO users (name, email, hashed_password, created)
 VALUES(?, ?, ?, UTC_TIMESTAMP())`
@@ -28,58 +52,653 @@ VALUES(?, ?, ?, UTC_TIMESTAMP())`
 	// our users_uc_email key by checking the contents of the message string.
 	// If it does, we return an ErrDuplicateEmail error. Otherwise, we just
 	// return the original error (or nil if everything worked).
-	_, err = m.DB.Exec(stmt, name, email, string(hashedPassword))
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(qctx, stmt, name, email, hashedPassword)
 	if err != nil {
 		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
 			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "users_uc_email") {
-				return models.ErrDuplicateEmail
+				return 0, models.ErrDuplicateEmail
 			}
 		}
+		return 0, err
 	}
-	return err
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// We'll use the InsertExternalContext method to add a new user who signed up
+// through an external identity provider, linked to their identity with it.
+// They don't have a password, and their email address is verified if the
+// provider says it is. The user and the identity are inserted in a
+// transaction, so that we never end up with a user who can't log in. It
+// returns the ID of the new user.
+func (m *UserModel) InsertExternalContext(ctx context.Context, name, email string, verified bool, issuer, subject string) (int, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO users (name, email, created, email_verified_at)
+	VALUES(?, ?, UTC_TIMESTAMP(), IF(?, UTC_TIMESTAMP(), NULL))`
+
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	result, err := tx.ExecContext(qctx, stmt, name, email, verified)
+	if err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "users_uc_email") {
+				return 0, models.ErrDuplicateEmail
+			}
+		}
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `INSERT INTO user_identities (issuer, subject, user_id, created)
+	VALUES(?, ?, ?, UTC_TIMESTAMP())`
+
+	qctx, cancel = queryContext(ctx, m.Timeout)
+	defer cancel()
+	_, err = tx.ExecContext(qctx, stmt, issuer, subject, id)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		return 0, models.ErrDuplicateIdentity
+	} else if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
 }
 
-// We'll use the Authenticate method to verify whether a user exists with
-// the provided email address and password. This will return the relevant
+// We'll use the AuthenticateContext method to verify whether a user exists
+// with the provided email address and password. This will return the relevant
 // user ID if they do.
-func (m *UserModel) Authenticate(email, password string) (int, error) {
+func (m *UserModel) AuthenticateContext(ctx context.Context, email, password string) (int, error) {
 	// Retrieve the id and hashed password associated with the given email. If don't
 	// matching email exists, we return the ErrInvalidCredentials error.
 	var id int
-	var hashedPassword []byte
-	row := m.DB.QueryRow("SELECT id, hashed_password FROM users WHERE email = ?", email)
-	err := row.Scan(&id, &hashedPassword)
+	var hashedPassword sql.NullString
+	var disabled bool
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	row := m.DB.QueryRowContext(qctx, "SELECT id, hashed_password, disabled FROM users WHERE email = ?", email)
+	err := row.Scan(&id, &hashedPassword, &disabled)
 	if err == sql.ErrNoRows {
 		return 0, models.ErrInvalidCredentials
 	} else if err != nil {
 		return 0, err
 	}
 
+	// Users who signed up through an external identity provider don't have
+	// a password, so they can't log in with one.
+	if hashedPassword.String == "" {
+		return 0, models.ErrInvalidCredentials
+	}
+
 	// Check whether the hashed password and plain-text password provided match
 	// If they don't, we return the ErrInvalidCredentials error.
-	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return 0, models.ErrInvalidCredentials
-	} else if err != nil {
+	match, rehash, err := m.hasher().Verify(password, hashedPassword.String)
+	if err != nil {
 		return 0, err
 	}
+	if !match {
+		return 0, models.ErrInvalidCredentials
+	}
+
+	// If the hash was made under an older hashing policy, now is our chance to
+	// replace it with one made under the current policy, as we have the
+	// plain-text password. This is best-effort: the old hash is still valid,
+	// so if the rehash fails we log it and try again at the next login.
+	if rehash {
+		err := m.rehash(ctx, id, password, hashedPassword.String)
+		if err != nil && m.Logger != nil {
+			m.Logger.Warn("rehashing password", "user_id", id, "error", err)
+		}
+	}
+
+	// The password is correct, but users whose account has been disabled
+	// still can't log in.
+	if disabled {
+		return 0, models.ErrAccountDisabled
+	}
 
 	// Otherwise, the password is correct. Return the user ID.
 	return id, nil
 }
 
-// We'll use the Get method to fetch details for a specific user based
+// The rehash method replaces a user's password hash with one made under the
+// current hashing policy. The update is conditional on the old hash, in case
+// the password was changed in the meantime.
+func (m *UserModel) rehash(ctx context.Context, id int, password, oldHash string) error {
+	newHash, err := m.hasher().Hash(password)
+	if err != nil {
+		return err
+	}
+	stmt := `UPDATE users SET hashed_password = ? WHERE id = ? AND hashed_password = ?`
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	_, err = m.DB.ExecContext(qctx, stmt, newHash, id, oldHash)
+	return err
+}
+
+// We'll use the GetContext method to fetch details for a specific user based
 // on their user ID.
-func (m *UserModel) Get(id int) (*models.User, error) {
+func (m *UserModel) GetContext(ctx context.Context, id int) (*models.User, error) {
 	s := &models.User{}
 
-	stmt := `SELECT id, name, email, created FROM users WHERE id = ?`
-	err := m.DB.QueryRow(stmt, id).Scan(&s.ID, &s.Name, &s.Email, &s.Created)
+	var verified sql.NullTime
+	stmt := `SELECT id, name, email, created, IFNULL(hashed_password, '') != '', email_verified_at, session_version,
+	totp_secret IS NOT NULL, role, disabled FROM users WHERE id = ?`
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(qctx, stmt, id).Scan(&s.ID, &s.Name, &s.Email, &s.Created, &s.HasPassword, &verified, &s.SessionVersion, &s.TOTPEnabled, &s.Role, &s.Disabled)
 	if err == sql.ErrNoRows {
 		return nil, models.ErrNoRecord
 	} else if err != nil {
 		return nil, err
 	}
+	s.EmailVerifiedAt = verified.Time
 
 	return s, nil
 }
+
+// We'll use the GetByEmailContext method to fetch details for a specific user
+// based on their email address.
+func (m *UserModel) GetByEmailContext(ctx context.Context, email string) (*models.User, error) {
+	s := &models.User{}
+
+	stmt := `SELECT id, name, email, created FROM users WHERE email = ?`
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(qctx, stmt, email).Scan(&s.ID, &s.Name, &s.Email, &s.Created)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// We'll use the UpdatePasswordContext method to replace a user's password with
+// a new one, storing a fresh hash of it. The user's session version is
+// incremented too, which invalidates all of their existing sessions.
+func (m *UserModel) UpdatePasswordContext(ctx context.Context, id int, password string) error {
+	hashedPassword, err := m.hasher().Hash(password)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE users SET hashed_password = ?, session_version = session_version + 1 WHERE id = ?`
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	_, err = m.DB.ExecContext(qctx, stmt, hashedPassword, id)
+	return err
+}
+
+// We'll use the ResetPasswordContext method to redeem a password reset token
+// and set the new password of the user it was issued to, in one transaction,
+// so that the token is only used up if the password is changed. All of the
+// user's other password reset tokens are deleted too. It returns the ID of the
+// user, or models.ErrNoRecord if the token doesn't exist or has expired.
+func (m *UserModel) ResetPasswordContext(ctx context.Context, token, password string) (int, error) {
+	hashedPassword, err := m.hasher().Hash(password)
+	if err != nil {
+		return 0, err
+	}
+
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	tx, err := m.DB.BeginTx(qctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the token's row, so that two concurrent requests can't both
+	// redeem it.
+	var id int
+	stmt := `SELECT user_id FROM tokens
+	WHERE hash = ? AND scope = ? AND expires > UTC_TIMESTAMP() FOR UPDATE`
+	err = tx.QueryRowContext(qctx, stmt, hashToken(token), ScopePasswordReset).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrNoRecord
+	} else if err != nil {
+		return 0, err
+	}
+
+	stmt = `UPDATE users SET hashed_password = ?, session_version = session_version + 1 WHERE id = ?`
+	_, err = tx.ExecContext(qctx, stmt, hashedPassword, id)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `DELETE FROM tokens WHERE user_id = ? AND scope = ?`
+	_, err = tx.ExecContext(qctx, stmt, id, ScopePasswordReset)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// We'll use the VerifyEmailContext method to record that a user has verified
+// their email address.
+func (m *UserModel) VerifyEmailContext(ctx context.Context, id int) error {
+	stmt := `UPDATE users SET email_verified_at = UTC_TIMESTAMP() WHERE id = ?`
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(qctx, stmt, id)
+	return err
+}
+
+// We'll use the UpdateEmailContext method to change a user's email address.
+// The new address hasn't been verified, so the verification time is cleared.
+// Links sent to the old address must no longer work, so the user's email
+// verification and password reset tokens are deleted in the same transaction;
+// otherwise whoever controls the old address could use a reset link to take
+// the account back. If the address is in use by another user,
+// models.ErrDuplicateEmail is returned.
+func (m *UserModel) UpdateEmailContext(ctx context.Context, id int, email string) error {
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	tx, err := m.DB.BeginTx(qctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `UPDATE users SET email = ?, email_verified_at = NULL WHERE id = ?`
+	_, err = tx.ExecContext(qctx, stmt, email, id)
+	if err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "users_uc_email") {
+				return models.ErrDuplicateEmail
+			}
+		}
+		return err
+	}
+
+	stmt = `DELETE FROM tokens WHERE user_id = ? AND scope IN (?, ?)`
+	_, err = tx.ExecContext(qctx, stmt, id, ScopeEmailVerification, ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The normalizeRecoveryCode function strips the formatting from a recovery
+// code, so that codes are accepted however they are typed in.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// We'll use the TOTPContext method to fetch a user's two-factor authentication
+// secret, which is empty if they haven't enabled it.
+func (m *UserModel) TOTPContext(ctx context.Context, id int) (string, error) {
+	var secret sql.NullString
+	stmt := `SELECT totp_secret FROM users WHERE id = ?`
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(qctx, stmt, id).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", models.ErrNoRecord
+	} else if err != nil {
+		return "", err
+	}
+	return secret.String, nil
+}
+
+// We'll use the EnableTOTPContext method to turn on two-factor authentication
+// for a user with the given secret, replacing any recovery codes they had with
+// hashes of the new ones.
+func (m *UserModel) EnableTOTPContext(ctx context.Context, id int, secret string, recoveryCodes []string) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	_, err = tx.ExecContext(qctx, `UPDATE users SET totp_secret = ?, totp_last_counter = NULL WHERE id = ?`, secret, id)
+	if err != nil {
+		return err
+	}
+	qctx, cancel = queryContext(ctx, m.Timeout)
+	defer cancel()
+	_, err = tx.ExecContext(qctx, `DELETE FROM recovery_codes WHERE user_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	for _, code := range recoveryCodes {
+		qctx, cancel := queryContext(ctx, m.Timeout)
+		defer cancel()
+		_, err = tx.ExecContext(qctx, `INSERT INTO recovery_codes (user_id, hash) VALUES(?, ?)`, id, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// We'll use the DisableTOTPContext method to turn off two-factor
+// authentication for a user, removing their secret and recovery codes.
+func (m *UserModel) DisableTOTPContext(ctx context.Context, id int) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	_, err = tx.ExecContext(qctx, `UPDATE users SET totp_secret = NULL, totp_last_counter = NULL WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	qctx, cancel = queryContext(ctx, m.Timeout)
+	defer cancel()
+	_, err = tx.ExecContext(qctx, `DELETE FROM recovery_codes WHERE user_id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// We'll use the UseTOTPCounterContext method to record that the code for a
+// time step has been used. It reports false if a code for that (or a later)
+// time step was already used, so that each code only works once.
+func (m *UserModel) UseTOTPCounterContext(ctx context.Context, id int, counter int64) (bool, error) {
+	stmt := `UPDATE users SET totp_last_counter = ?
+	WHERE id = ? AND (totp_last_counter IS NULL OR totp_last_counter < ?)`
+
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(qctx, stmt, counter, id, counter)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// We'll use the UseRecoveryCodeContext method to redeem one of a user's
+// recovery codes. The code is deleted, so it reports false if the code doesn't
+// exist or was already used.
+func (m *UserModel) UseRecoveryCodeContext(ctx context.Context, id int, code string) (bool, error) {
+	stmt := `DELETE FROM recovery_codes WHERE user_id = ? AND hash = ?`
+
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(qctx, stmt, id, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// The likePattern function returns a LIKE pattern matching values which
+// contain query, escaping any wildcards in it.
+func likePattern(query string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(query) + "%"
+}
+
+// This will return the 50 newest users whose name or email address contains
+// the query. An empty query matches every user.
+func (m *UserModel) SearchContext(ctx context.Context, query string) ([]*models.User, error) {
+	stmt := `SELECT id, name, email, created, role, disabled FROM users
+	WHERE name LIKE ? OR email LIKE ? ORDER BY created DESC LIMIT 50`
+
+	pattern := likePattern(query)
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(qctx, stmt, pattern, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*models.User{}
+	for rows.Next() {
+		u := &models.User{}
+		err = rows.Scan(&u.ID, &u.Name, &u.Email, &u.Created, &u.Role, &u.Disabled)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// We'll use the SetRoleContext method to change the role of the user with the
+// given email address. If there's no such user, models.ErrNoRecord is
+// returned.
+func (m *UserModel) SetRoleContext(ctx context.Context, email, role string) error {
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(qctx, `UPDATE users SET role = ? WHERE email = ?`, role, email)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	// RowsAffected doesn't count rows which already had the role, so check
+	// whether the user exists before reporting that they don't.
+	if n == 0 {
+		_, err = m.GetByEmailContext(ctx, email)
+		return err
+	}
+	return nil
+}
+
+// We'll use the SetDisabledContext method to disable or re-enable a user's
+// account.
+func (m *UserModel) SetDisabledContext(ctx context.Context, id int, disabled bool) error {
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(qctx, `UPDATE users SET disabled = ? WHERE id = ?`, disabled, id)
+	return err
+}
+
+// We'll use the DeleteContext method to remove a user along with everything
+// they've created: their snippets (and the stars, comments and views on them),
+// their comments, their stars, and all of their tokens and sessions. Other
+// users' replies to the user's comments are kept as top-level comments.
+//
+// If anonymise is set, the user's snippets are kept without an owner instead,
+// along with their stars, comments and views. Private snippets are deleted
+// anyway, as nobody else could ever see them.
+func (m *UserModel) DeleteContext(ctx context.Context, id int, anonymise bool) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The condition matching the snippets which are deleted.
+	deleted := `user_id = ?`
+	if anonymise {
+		deleted = `user_id = ? AND private = TRUE`
+	}
+
+	// Every placeholder in these statements is the user's ID. The derived
+	// table is needed because MySQL doesn't allow an UPDATE or DELETE to
+	// select from the table it's changing directly.
+	stmts := []string{
+		`DELETE FROM stars WHERE user_id = ? OR snippet_id IN (SELECT id FROM snippets WHERE ` + deleted + `)`,
+		`DELETE FROM snippet_views WHERE snippet_id IN (SELECT id FROM snippets WHERE ` + deleted + `)`,
+		`DELETE FROM comments WHERE snippet_id IN (SELECT id FROM snippets WHERE ` + deleted + `)`,
+		`UPDATE comments SET parent_id = NULL WHERE parent_id IN (SELECT id FROM (SELECT id FROM comments WHERE user_id = ?) c)`,
+		`DELETE FROM comments WHERE user_id = ?`,
+		`DELETE FROM snippets WHERE ` + deleted,
+		`UPDATE snippets SET user_id = NULL WHERE user_id = ?`,
+		`DELETE FROM tokens WHERE user_id = ?`,
+		`DELETE FROM recovery_codes WHERE user_id = ?`,
+		`DELETE FROM sessions WHERE user_id = ?`,
+		`DELETE FROM remember_tokens WHERE user_id = ?`,
+		`DELETE FROM user_identities WHERE user_id = ?`,
+	}
+	for _, stmt := range stmts {
+		args := make([]interface{}, strings.Count(stmt, "?"))
+		for i := range args {
+			args[i] = id
+		}
+		qctx, cancel := queryContext(ctx, m.Timeout)
+		defer cancel()
+		_, err = tx.ExecContext(qctx, stmt, args...)
+		if err != nil {
+			return err
+		}
+	}
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	_, err = tx.ExecContext(qctx, `DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// We'll use the ExportContext method to gather everything we hold about a user
+// for them to download: their profile, linked identities, snippets (including
+// private and expired ones), comments and stars. The queries run in a single
+// transaction, so that they see a consistent view of the data.
+func (m *UserModel) ExportContext(ctx context.Context, id int) (*models.Export, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	e := &models.Export{
+		Exported:   time.Now().UTC(),
+		Identities: []models.ExportedIdentity{},
+		Snippets:   []models.ExportedSnippet{},
+		Comments:   []models.ExportedComment{},
+		Starred:    []int{},
+	}
+
+	var verified sql.NullTime
+	stmt := `SELECT id, name, email, created, email_verified_at, role, totp_secret IS NOT NULL
+	FROM users WHERE id = ?`
+	qctx, cancel := queryContext(ctx, m.Timeout)
+	defer cancel()
+	err = tx.QueryRowContext(qctx, stmt, id).Scan(&e.User.ID, &e.User.Name, &e.User.Email, &e.User.Created, &verified, &e.User.Role, &e.User.TwoFactorEnabled)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+	if verified.Valid {
+		e.User.EmailVerifiedAt = &verified.Time
+	}
+
+	// The scanAll function runs a query for the user's rows, calling scan
+	// for each of them.
+	scanAll := func(stmt string, scan func(*sql.Rows) error) error {
+		qctx, cancel := queryContext(ctx, m.Timeout)
+		defer cancel()
+		rows, err := tx.QueryContext(qctx, stmt, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			err = scan(rows)
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+
+	err = scanAll(`SELECT issuer, subject, created FROM user_identities WHERE user_id = ? ORDER BY created`, func(rows *sql.Rows) error {
+		var i models.ExportedIdentity
+		err := rows.Scan(&i.Issuer, &i.Subject, &i.Created)
+		if err != nil {
+			return err
+		}
+		e.Identities = append(e.Identities, i)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanAll(`SELECT id, title, content, created, expires, private, hashed_password IS NOT NULL, encrypted,
+	IFNULL(ciphertext, ''), IFNULL(cipher_meta, '') FROM snippets WHERE user_id = ? ORDER BY id`, func(rows *sql.Rows) error {
+		var s models.ExportedSnippet
+		err := rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires, &s.Private, &s.PasswordProtected, &s.Encrypted, &s.Ciphertext, &s.CipherMeta)
+		if err != nil {
+			return err
+		}
+		e.Snippets = append(e.Snippets, s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanAll(`SELECT id, snippet_id, IFNULL(parent_id, 0), content, created, updated
+	FROM comments WHERE user_id = ? ORDER BY id`, func(rows *sql.Rows) error {
+		var c models.ExportedComment
+		err := rows.Scan(&c.ID, &c.SnippetID, &c.ParentID, &c.Content, &c.Created, &c.Updated)
+		if err != nil {
+			return err
+		}
+		e.Comments = append(e.Comments, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanAll(`SELECT snippet_id FROM stars WHERE user_id = ? ORDER BY created`, func(rows *sql.Rows) error {
+		var snippetID int
+		err := rows.Scan(&snippetID)
+		if err != nil {
+			return err
+		}
+		e.Starred = append(e.Starred, snippetID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
@@ -0,0 +1,381 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+
+	"snippetbox/pkg/models"
+	"snippetbox/pkg/passwords"
+)
+
+// The testFixture type holds a user with some content, and another user who
+// has interacted with it, for testing what happens to a user's data.
+type testFixture struct {
+	db       *sql.DB
+	users    *UserModel
+	snippets *SnippetModel
+	comments *CommentModel
+
+	userID, otherID int
+	// The user's public and private snippets, and a snippet by the other
+	// user.
+	public, private, others int
+	// A comment by the other user on the user's public snippet, a comment by
+	// the user on the other user's snippet, and the other user's reply to it.
+	otherComment, userComment, otherReply int
+	sessionToken                          string
+}
+
+func newTestFixture(t *testing.T) *testFixture {
+	ctx := context.Background()
+	db := newTestDB(t)
+	f := &testFixture{
+		db: db,
+		// Use the cheapest bcrypt cost so the tests run quickly.
+		users:    &UserModel{DB: db, Passwords: &passwords.Hasher{Algorithm: passwords.Bcrypt, BcryptCost: 4}},
+		snippets: &SnippetModel{DB: db},
+		comments: &CommentModel{DB: db},
+	}
+	stars := &StarModel{DB: db}
+	sessions := &SessionModel{DB: db}
+
+	var err error
+	check := func() {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.userID, err = f.users.InsertContext(ctx, "Alice", "alice@example.com", "correct horse battery")
+	check()
+	f.otherID, err = f.users.InsertContext(ctx, "Bob", "bob@example.com", "correct horse battery")
+	check()
+
+	f.public, err = f.snippets.Insert("Public", "Public content", "7", f.userID, false, "")
+	check()
+	f.private, err = f.snippets.Insert("Private", "Private content", "7", f.userID, true, "")
+	check()
+	f.others, err = f.snippets.Insert("Bob's", "Bob's content", "7", f.otherID, false, "")
+	check()
+
+	err = stars.Insert(f.otherID, f.public)
+	check()
+	err = stars.Insert(f.userID, f.others)
+	check()
+	f.otherComment, err = f.comments.Insert(f.public, f.otherID, 0, "Nice snippet")
+	check()
+	f.userComment, err = f.comments.Insert(f.others, f.userID, 0, "Thanks for sharing")
+	check()
+	f.otherReply, err = f.comments.Insert(f.others, f.otherID, f.userComment, "You're welcome")
+	check()
+	f.sessionToken, err = sessions.Create(f.userID, "192.0.2.1", "Go-http-client", time.Hour)
+	check()
+
+	return f
+}
+
+func TestUserModelDelete(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		anonymise bool
+	}{
+		{"Delete snippets", false},
+		{"Anonymise snippets", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFixture(t)
+
+			err := f.users.DeleteContext(ctx, f.userID, tt.anonymise)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = f.users.GetContext(ctx, f.userID)
+			if err != models.ErrNoRecord {
+				t.Errorf("want user to be deleted; got %v", err)
+			}
+			_, err = (&SessionModel{DB: f.db}).Get(f.sessionToken)
+			if err != models.ErrNoRecord {
+				t.Errorf("want session to be deleted; got %v", err)
+			}
+
+			// The public snippet, and the other user's comment on it, are
+			// only kept if they're anonymised.
+			s, err := f.snippets.Get(f.public)
+			if tt.anonymise {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s.UserID != 0 {
+					t.Errorf("want anonymised snippet to have no owner; got user %d", s.UserID)
+				}
+			} else if err != models.ErrNoRecord {
+				t.Errorf("want public snippet to be deleted; got %v", err)
+			}
+			_, err = f.comments.Get(f.otherComment)
+			if tt.anonymise && err != nil {
+				t.Errorf("want comment on anonymised snippet to be kept; got %v", err)
+			} else if !tt.anonymise && err != models.ErrNoRecord {
+				t.Errorf("want comment on deleted snippet to be deleted; got %v", err)
+			}
+
+			// The private snippet and the user's comments are always deleted.
+			_, err = f.snippets.Get(f.private)
+			if err != models.ErrNoRecord {
+				t.Errorf("want private snippet to be deleted; got %v", err)
+			}
+			_, err = f.comments.Get(f.userComment)
+			if err != models.ErrNoRecord {
+				t.Errorf("want user's comment to be deleted; got %v", err)
+			}
+
+			// The other user's content is untouched.
+			_, err = f.snippets.Get(f.others)
+			if err != nil {
+				t.Errorf("want other user's snippet to be kept; got %v", err)
+			}
+			// The other user's reply to the user's comment is kept as a
+			// top-level comment.
+			c, err := f.comments.Get(f.otherReply)
+			if err != nil {
+				t.Errorf("want other user's reply to be kept; got %v", err)
+			} else if c.ParentID != 0 {
+				t.Errorf("want reply to become a top-level comment; got parent %d", c.ParentID)
+			}
+			_, err = f.users.GetContext(ctx, f.otherID)
+			if err != nil {
+				t.Errorf("want other user to be kept; got %v", err)
+			}
+		})
+	}
+}
+
+func TestUserModelExport(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFixture(t)
+
+	e, err := f.users.ExportContext(ctx, f.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.User.ID != f.userID || e.User.Name != "Alice" || e.User.Email != "alice@example.com" {
+		t.Errorf("unexpected profile %+v", e.User)
+	}
+	if e.User.EmailVerifiedAt != nil {
+		t.Errorf("want no verification time; got %v", e.User.EmailVerifiedAt)
+	}
+
+	// Both of the user's snippets are exported, including the private one,
+	// but not the other user's.
+	if len(e.Snippets) != 2 || e.Snippets[0].ID != f.public || e.Snippets[1].ID != f.private {
+		t.Fatalf("want snippets %d and %d; got %+v", f.public, f.private, e.Snippets)
+	}
+	if e.Snippets[0].Content != "Public content" || !e.Snippets[1].Private {
+		t.Errorf("unexpected snippets %+v", e.Snippets)
+	}
+
+	if len(e.Comments) != 1 || e.Comments[0].ID != f.userComment || e.Comments[0].SnippetID != f.others {
+		t.Errorf("want comment %d; got %+v", f.userComment, e.Comments)
+	}
+	if len(e.Starred) != 1 || e.Starred[0] != f.others {
+		t.Errorf("want starred snippet %d; got %v", f.others, e.Starred)
+	}
+
+	_, err = f.users.ExportContext(ctx, f.otherID+1)
+	if err != models.ErrNoRecord {
+		t.Errorf("want %v for a missing user; got %v", models.ErrNoRecord, err)
+	}
+}
+
+func TestUserModelResetPassword(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	users := &UserModel{DB: db}
+	tokens := &TokenModel{DB: db}
+
+	userID, err := users.InsertContext(ctx, "Alice", "alice@example.com", "pa$$word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.New(userID, time.Hour, ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := tokens.New(userID, time.Hour, ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Redeem the same link twice at once. Only one of the requests may use
+	// it; the other must find it gone.
+	newPasswords := []string{"first new password", "second new password"}
+	errs := make([]error, len(newPasswords))
+	var wg sync.WaitGroup
+	for i, password := range newPasswords {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = users.ResetPasswordContext(ctx, token, password)
+		}()
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch err {
+		case nil:
+			if winner != -1 {
+				t.Fatal("want the link to be redeemed once; got twice")
+			}
+			winner = i
+		case models.ErrNoRecord:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if winner == -1 {
+		t.Fatal("want the link to be redeemed once; got never")
+	}
+
+	// The password set is the one from the request which redeemed the link.
+	id, err := users.AuthenticateContext(ctx, "alice@example.com", newPasswords[winner])
+	if err != nil || id != userID {
+		t.Errorf("want to log in with the new password; got %d, %v", id, err)
+	}
+
+	// The user's other reset links stop working too.
+	ok, err := tokens.Check(other, ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("want other reset links deleted")
+	}
+}
+
+func TestUserModelUpdateEmail(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	users := &UserModel{DB: db}
+	tokens := &TokenModel{DB: db}
+
+	userID, err := users.InsertContext(ctx, "Alice", "alice@example.com", "pa$$word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.InsertContext(ctx, "Bob", "bob@example.com", "pa$$word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset, err := tokens.New(userID, time.Hour, ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify, err := tokens.New(userID, time.Hour, ScopeEmailVerification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Taking another user's address fails, and leaves the links working.
+	err = users.UpdateEmailContext(ctx, userID, "bob@example.com")
+	if err != models.ErrDuplicateEmail {
+		t.Fatalf("want %v; got %v", models.ErrDuplicateEmail, err)
+	}
+	ok, err := tokens.Check(reset, ScopePasswordReset)
+	if err != nil || !ok {
+		t.Fatalf("want reset link kept; got %v, %v", ok, err)
+	}
+
+	err = users.UpdateEmailContext(ctx, userID, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A reset link sent to the old address can't be used after the change.
+	_, err = users.ResetPasswordContext(ctx, reset, "new password")
+	if err != models.ErrNoRecord {
+		t.Errorf("want %v; got %v", models.ErrNoRecord, err)
+	}
+	ok, err = tokens.Check(verify, ScopeEmailVerification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("want verification link deleted")
+	}
+}
+
+func TestUserModelInsertExternal(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	users := &UserModel{DB: db}
+	identities := &IdentityModel{DB: db}
+
+	id, err := users.InsertExternalContext(ctx, "Alice", "alice@example.com", true, "https://idp.example.com", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked, err := identities.Get("https://idp.example.com", "alice"); err != nil || linked != id {
+		t.Errorf("want identity linked to user %d; got %d (%v)", id, linked, err)
+	}
+
+	// If the identity can't be inserted, neither is the user.
+	_, err = users.InsertExternalContext(ctx, "Mallory", "mallory@example.com", true, "https://idp.example.com", "alice")
+	if err != models.ErrDuplicateIdentity {
+		t.Fatalf("want ErrDuplicateIdentity; got %v", err)
+	}
+	if _, err := users.GetByEmailContext(ctx, "mallory@example.com"); err != models.ErrNoRecord {
+		t.Errorf("want user not to be inserted; got %v", err)
+	}
+}
+
+func TestUserModelAuthenticateRehashFails(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The password was hashed under a cheaper policy than the current one,
+	// so logging in triggers a rehash.
+	old := &passwords.Hasher{Algorithm: passwords.Bcrypt, BcryptCost: bcrypt.MinCost}
+	hash, err := old.Hash("pa$$word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := &UserModel{
+		DB:        db,
+		Passwords: &passwords.Hasher{Algorithm: passwords.Bcrypt, BcryptCost: bcrypt.MinCost + 1},
+	}
+
+	mock.ExpectQuery("SELECT id, hashed_password, disabled FROM users").
+		WithArgs("alice@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hashed_password", "disabled"}).AddRow(1, hash, false))
+	mock.ExpectExec("UPDATE users SET hashed_password").
+		WillReturnError(errors.New("database is read-only"))
+
+	// The rehash failing doesn't stop the user logging in.
+	id, err := users.AuthenticateContext(ctx, "alice@example.com", "pa$$word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Errorf("want user 1; got %d", id)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,78 @@
+package mysql
+
+import (
+	"database/sql"
+	"time"
+
+	"snippetbox/pkg/models"
+)
+
+// Define a ViewModel type which wraps a sql.DB connection pool.
+type ViewModel struct {
+	DB *sql.DB
+}
+
+// We'll use the Add method to add a batch of view counts, keyed by snippet ID,
+// to the totals for the given day. The whole batch is written in a single
+// transaction.
+func (m *ViewModel) Add(day time.Time, counts map[int]int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO snippet_views (snippet_id, day, views) VALUES(?, ?, ?)
+	ON DUPLICATE KEY UPDATE views = views + VALUES(views)`
+
+	for id, count := range counts {
+		_, err = tx.Exec(stmt, id, day.UTC().Format("2006-01-02"), count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// The Total method returns the total number of views for a specific snippet.
+func (m *ViewModel) Total(snippetID int) (int, error) {
+	var total int
+	stmt := `SELECT IFNULL(SUM(views), 0) FROM snippet_views WHERE snippet_id = ?`
+	err := m.DB.QueryRow(stmt, snippetID).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// The Daily method returns the number of views per day across all of a
+// user's snippets over the last given number of days, oldest first. Days
+// without any views are left out.
+func (m *ViewModel) Daily(userID, days int) ([]*models.DailyViews, error) {
+	stmt := `SELECT v.day, SUM(v.views) FROM snippet_views v
+	INNER JOIN snippets s ON s.id = v.snippet_id
+	WHERE s.user_id = ? AND v.day > DATE_SUB(UTC_DATE(), INTERVAL ? DAY)
+	GROUP BY v.day ORDER BY v.day`
+
+	rows, err := m.DB.Query(stmt, userID, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := []*models.DailyViews{}
+	for rows.Next() {
+		v := &models.DailyViews{}
+		err = rows.Scan(&v.Day, &v.Views)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, v)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return views, nil
+}
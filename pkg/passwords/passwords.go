@@ -0,0 +1,161 @@
+// Package passwords hashes and verifies passwords according to a configurable
+// policy, using either bcrypt or argon2id. Hashes are self-describing: bcrypt
+// hashes are in the usual "$2a$<cost>$..." form, and argon2id hashes in the
+// PHC string format "$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>",
+// so hashes made under an older policy can still be verified, and can be
+// recognised as needing to be rehashed.
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Define the hashing algorithms a Hasher can use.
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// ErrUnknownHash is returned when verifying a password against a hash which
+// isn't in a format this package recognises.
+var ErrUnknownHash = errors.New("passwords: unknown hash format")
+
+// Argon2Params holds the parameters for argon2id hashing. Memory is in KiB.
+type Argon2Params struct {
+	Memory     uint32
+	Time       uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// Hasher hashes passwords with its Algorithm, using BcryptCost for bcrypt
+// or the Argon2 parameters for argon2id.
+type Hasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// DefaultArgon2 holds the argon2id parameters recommended by RFC 9106 for
+// memory-constrained environments.
+var DefaultArgon2 = Argon2Params{Memory: 64 * 1024, Time: 3, Threads: 2, SaltLength: 16, KeyLength: 32}
+
+// Default is the Hasher used when none is configured: bcrypt with a cost of
+// 12, which is what the application has always used.
+var Default = &Hasher{Algorithm: Bcrypt, BcryptCost: 12, Argon2: DefaultArgon2}
+
+// Validate checks that the Hasher's policy is usable.
+func (h *Hasher) Validate() error {
+	switch h.Algorithm {
+	case Bcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("passwords: bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case Argon2id:
+		p := h.Argon2
+		if p.Memory == 0 || p.Time == 0 || p.Threads == 0 || p.SaltLength == 0 || p.KeyLength == 0 {
+			return errors.New("passwords: argon2id parameters must not be zero")
+		}
+	default:
+		return fmt.Errorf("passwords: unknown algorithm %q", h.Algorithm)
+	}
+	return nil
+}
+
+// Hash returns a self-describing hash of the password.
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.Algorithm == Argon2id {
+		p := h.Argon2
+		salt := make([]byte, p.SaltLength)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify reports whether the password matches the hash, and, if it does,
+// whether the hash should be replaced because it wasn't made under the
+// Hasher's current policy.
+func (h *Hasher) Verify(password, hash string) (match bool, rehash bool, err error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return false, false, err
+		}
+		return true, h.Algorithm != Bcrypt || cost != h.BcryptCost, nil
+
+	case strings.HasPrefix(hash, "$argon2id$"):
+		p, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return false, false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLength)
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return false, false, nil
+		}
+		return true, h.Algorithm != Argon2id || p != h.Argon2, nil
+	}
+
+	return false, false, ErrUnknownHash
+}
+
+// The decodeArgon2 function parses an argon2id hash in the PHC string format
+// into its parameters, salt and key. Hashes with a zero parameter or an empty
+// key are rejected, as argon2.IDKey panics on them.
+func decodeArgon2(hash string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+	if err != nil || p.Memory == 0 || p.Time == 0 || p.Threads == 0 {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+
+	return p, salt, key, nil
+}
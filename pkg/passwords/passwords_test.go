@@ -0,0 +1,151 @@
+package passwords
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap policies, so that the tests run quickly.
+var (
+	cheapBcrypt   = &Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}
+	cheapArgon2id = &Hasher{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 1024, Time: 1, Threads: 1, SaltLength: 16, KeyLength: 32}}
+)
+
+func TestHashAndVerify(t *testing.T) {
+	for _, h := range []*Hasher{cheapBcrypt, cheapArgon2id} {
+		t.Run(h.Algorithm, func(t *testing.T) {
+			hash, err := h.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hash) > 255 {
+				t.Errorf("hash is too long for the hashed_password column: %d", len(hash))
+			}
+
+			match, rehash, err := h.Verify("correct horse", hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !match || rehash {
+				t.Errorf("want match without rehash; got match=%v rehash=%v", match, rehash)
+			}
+
+			match, _, err = h.Verify("wrong horse", hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match {
+				t.Error("want wrong password not to match")
+			}
+		})
+	}
+}
+
+func TestVerifyRehash(t *testing.T) {
+	stronger := &Hasher{Algorithm: Argon2id, Argon2: cheapArgon2id.Argon2}
+	stronger.Argon2.Time = 2
+
+	tests := []struct {
+		name   string
+		old    *Hasher
+		policy *Hasher
+		want   bool
+	}{
+		{name: "Same policy", old: cheapBcrypt, policy: cheapBcrypt, want: false},
+		{name: "Bcrypt cost", old: cheapBcrypt, policy: &Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost + 1}, want: true},
+		{name: "Bcrypt to argon2id", old: cheapBcrypt, policy: cheapArgon2id, want: true},
+		{name: "Argon2id to bcrypt", old: cheapArgon2id, policy: cheapBcrypt, want: true},
+		{name: "Argon2id parameters", old: cheapArgon2id, policy: stronger, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := tt.old.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			match, rehash, err := tt.policy.Verify("correct horse", hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !match {
+				t.Fatal("want old hash to still match")
+			}
+			if rehash != tt.want {
+				t.Errorf("want rehash %v; got %v", tt.want, rehash)
+			}
+		})
+	}
+}
+
+func TestVerifyUnknownHash(t *testing.T) {
+	hashes := []string{
+		"",
+		"plain",
+		"$argon2id$v=19$m=x$salt$key",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5",
+		// Zero parameters and empty keys would make argon2.IDKey panic.
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdA$a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+	}
+	for _, hash := range hashes {
+		_, _, err := cheapBcrypt.Verify("password", hash)
+		if err != ErrUnknownHash {
+			t.Errorf("%q: want ErrUnknownHash; got %v", hash, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default.Validate(); err != nil {
+		t.Errorf("want default policy to be valid; got %v", err)
+	}
+	invalid := []*Hasher{
+		{Algorithm: "md5"},
+		{Algorithm: Bcrypt, BcryptCost: 99},
+		{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 1024}},
+	}
+	for _, h := range invalid {
+		if err := h.Validate(); err == nil {
+			t.Errorf("want %+v to be invalid", h)
+		}
+	}
+}
+
+// loginBudget is the most time verifying a password under the default
+// policies may take, as it's most of the latency of a login.
+const loginBudget = 500 * time.Millisecond
+
+// The benchmarkVerify function benchmarks verifying a password under a
+// policy, and fails if it takes longer than the login budget.
+func benchmarkVerify(b *testing.B, h *Hasher) {
+	hash, err := h.Hash("correct horse battery staple")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		_, _, err = h.Verify("correct horse battery staple", hash)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if per := time.Since(start) / time.Duration(b.N); per > loginBudget {
+		b.Errorf("verifying a password took %s, over the %s login budget", per, loginBudget)
+	}
+}
+
+func BenchmarkVerifyBcrypt(b *testing.B) {
+	benchmarkVerify(b, Default)
+}
+
+func BenchmarkVerifyArgon2id(b *testing.B) {
+	benchmarkVerify(b, &Hasher{Algorithm: Argon2id, Argon2: DefaultArgon2})
+}
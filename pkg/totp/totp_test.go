@@ -0,0 +1,71 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// The secret used by the SHA1 test vectors in RFC 6238 appendix B.
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// The RFC test vectors use 8 digits, so we compare against their last 6.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Counter(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("at %d: want %q; got %q", tt.unix, tt.want, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	// Codes from the neighbouring time steps are accepted.
+	for _, offset := range []time.Duration{-Period, 0, Period} {
+		code, _ := Code(rfcSecret, Counter(now.Add(offset)))
+		counter, ok := Validate(rfcSecret, code, now)
+		if !ok {
+			t.Errorf("offset %s: want code to be valid", offset)
+		}
+		if counter != Counter(now.Add(offset)) {
+			t.Errorf("offset %s: want counter %d; got %d", offset, Counter(now.Add(offset)), counter)
+		}
+	}
+
+	// But not those from further away.
+	code, _ := Code(rfcSecret, Counter(now.Add(-2*Period)))
+	if _, ok := Validate(rfcSecret, code, now); ok {
+		t.Error("want code from two steps ago to be invalid")
+	}
+
+	if _, ok := Validate(rfcSecret, "12345", now); ok {
+		t.Error("want short code to be invalid")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Errorf("want secret to be usable; got %s", err)
+	}
+}
@@ -0,0 +1,100 @@
+// Encrypted snippets are encrypted and decrypted in the browser with
+// AES-GCM. The key is kept in the URL fragment, which browsers never send to
+// the server, so the server only ever sees the ciphertext.
+
+function toBase64URL(buf) {
+	var bytes = new Uint8Array(buf);
+	var s = "";
+	for (var i = 0; i < bytes.length; i++) {
+		s += String.fromCharCode(bytes[i]);
+	}
+	return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function fromBase64URL(s) {
+	s = s.replace(/-/g, "+").replace(/_/g, "/");
+	while (s.length % 4) {
+		s += "=";
+	}
+	var bin = atob(s);
+	var bytes = new Uint8Array(bin.length);
+	for (var i = 0; i < bin.length; i++) {
+		bytes[i] = bin.charCodeAt(i);
+	}
+	return bytes;
+}
+
+function encryptSnippet(form) {
+	var errorBox = document.getElementById("encrypt-error");
+	var iv = crypto.getRandomValues(new Uint8Array(12));
+	var plaintext = new TextEncoder().encode(form.elements["content"].value);
+	var key;
+
+	crypto.subtle.generateKey({name: "AES-GCM", length: 256}, true, ["encrypt"]).then(function(k) {
+		key = k;
+		return crypto.subtle.encrypt({name: "AES-GCM", iv: iv}, key, plaintext);
+	}).then(function(ciphertext) {
+		return fetch(form.action, {
+			method: "POST",
+			credentials: "same-origin",
+			headers: {
+				"Content-Type": "application/json",
+				"X-CSRF-Token": form.elements["csrf_token"].value
+			},
+			body: JSON.stringify({
+				ciphertext: toBase64URL(ciphertext),
+				meta: JSON.stringify({v: 1, alg: "AES-GCM", iv: toBase64URL(iv)}),
+				expires: form.elements["expires"].value
+			})
+		});
+	}).then(function(res) {
+		if (!res.ok) {
+			throw new Error("The snippet could not be saved (" + res.status + ")");
+		}
+		return Promise.all([res.json(), crypto.subtle.exportKey("raw", key)]);
+	}).then(function(results) {
+		window.location = results[0].url + "#" + toBase64URL(results[1]);
+	}).catch(function(err) {
+		errorBox.textContent = err.message;
+		errorBox.hidden = false;
+	});
+}
+
+function decryptSnippet(container) {
+	var code = container.querySelector("code");
+	var rawKey = window.location.hash.slice(1);
+	if (!rawKey) {
+		code.textContent = "This link is missing its decryption key.";
+		return;
+	}
+
+	var meta;
+	fetch("/api/snippet/" + container.dataset.id + "/ciphertext", {credentials: "same-origin"}).then(function(res) {
+		if (!res.ok) {
+			throw new Error("The snippet could not be loaded (" + res.status + ")");
+		}
+		return res.json();
+	}).then(function(data) {
+		meta = JSON.parse(data.meta);
+		return crypto.subtle.importKey("raw", fromBase64URL(rawKey), {name: "AES-GCM"}, false, ["decrypt"]).then(function(key) {
+			return crypto.subtle.decrypt({name: "AES-GCM", iv: fromBase64URL(meta.iv)}, key, fromBase64URL(data.ciphertext));
+		});
+	}).then(function(plaintext) {
+		code.textContent = new TextDecoder().decode(plaintext);
+	}).catch(function(err) {
+		code.textContent = err.message || "The snippet could not be decrypted. Check the link is complete.";
+	});
+}
+
+var encryptForm = document.getElementById("encrypt-form");
+if (encryptForm) {
+	encryptForm.addEventListener("submit", function(e) {
+		e.preventDefault();
+		encryptSnippet(encryptForm);
+	});
+}
+
+var encryptedSnippet = document.getElementById("encrypted-snippet");
+if (encryptedSnippet) {
+	decryptSnippet(encryptedSnippet);
+}